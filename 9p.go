@@ -7,7 +7,9 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"path"
+	"sync"
 
 	"aqwari.net/net/styx"
 	"github.com/Azure/azure-storage-file-go/azfile"
@@ -16,9 +18,14 @@ import (
 // 9p server container - implements interfaces for styx
 type Server struct {
 	*File
-	share azfile.ShareURL
-	svc   azfile.ServiceURL
-	ctx   context.Context
+	tree     sync.RWMutex // Guards the shape of the File tree, sessions run concurrently
+	renames  sync.Mutex   // Serialises renames, the only holders of several blob locks
+	share    azfile.ShareURL
+	svc      azfile.ServiceURL
+	ctx      context.Context
+	state    sync.Mutex     // Guards closing
+	closing  bool           // Shutting down, new requests are refused
+	inflight sync.WaitGroup // Requests being served
 }
 
 // Init the server and its file system - call only once
@@ -27,7 +34,7 @@ func (s *Server) Initialize() {
 }
 
 // Look up a file by path string
-func lookup(srv Server, full string) (*File, error) {
+func lookup(srv *Server, full string) (*File, error) {
 	// Sync root
 	srv.File.Sync()
 
@@ -48,85 +55,184 @@ func lookup(srv Server, full string) (*File, error) {
 
 // Handle 9p requests to the server - each new connection will call this
 func (srv *Server) Serve9P(s *styx.Session) {
-Loop:
 	for s.Next() {
 		msg := s.Request()
-		file := path.Clean(msg.Path())
-		log.Println("Handling: ", file)
-
-		// Switch on the kind of message we are receiving, not all will arrive here and are handled by styx
-		// Only every give styx a VFile to ensure it can cast interfaces correctly
-		switch t := msg.(type) {
-		case styx.Twalk:
-			log.Println("=== walk: ", t)
-			f, err := lookup(*srv, file)
-			if err != nil {
-				t.Rerror("tree walk failed → %s", err)
-			}
-			if f.IsDir() {
-				err = f.LoadChildren()
-			}
-			t.Rwalk(f.VF(), err)
-
-		case styx.Topen:
-			log.Println("=== open: ", t)
-			f, err := lookup(*srv, file)
-			t.Ropen(f.VF(), err)
-
-		case styx.Tstat:
-			log.Println("=== stat: ", t)
-			f, err := lookup(*srv, file)
-			t.Rstat(f.VF(), err)
-
-		case styx.Tcreate:
-			log.Println("=== create: ", t)
-			// TODO - something special for directories?
-			full := file + t.Name
-
-			// Insert into file tree
-			f, err := srv.File.Insert(full, false)
-			if err != nil {
-				t.Rerror("tree insert failed %s", err)
-				continue Loop
-			}
 
-			// Upload to blob storage
+		// Requests arriving once shutdown began are refused, those already here are finished
+		if !srv.enter() {
+			msg.Rerror("%s", errShutdown)
+			continue
+		}
+		srv.handle(msg)
+		srv.leave()
+	}
+}
+
+// Handle a single 9p request
+func (srv *Server) handle(msg styx.Request) {
+	file := path.Clean(msg.Path())
+	log.Println("Handling: ", file)
+
+	// Switch on the kind of message we are receiving, not all will arrive here and are handled by styx
+	// Only every give styx a VFile to ensure it can cast interfaces correctly
+	switch t := msg.(type) {
+	case styx.Twalk:
+		log.Println("=== walk: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rerror("tree walk failed → %s", err)
+		}
+		if f.IsDir() {
+			err = f.LoadChildren()
+		}
+		t.Rwalk(f.VF(), err)
+
+	case styx.Topen:
+		log.Println("=== open: ", t)
+		f, err := lookup(srv, file)
+
+		// Honour OTRUNC, the file is emptied before use
+		if err == nil && !f.isDir && t.Flag&os.O_TRUNC != 0 {
+			err = f.Truncate(0)
+		} else if err == nil && t.Flag&os.O_WRONLY == 0 {
+			// Contents are only fetched once opened for reading
+			err = f.Fetch()
+		}
+
+		if err == nil {
+			f.Blob.opened()
+		}
+		t.Ropen(f.VF(), err)
+
+	case styx.Tstat:
+		log.Println("=== stat: ", t)
+		f, err := lookup(srv, file)
+		t.Rstat(f.VF(), err)
+
+	case styx.Tcreate:
+		log.Println("=== create: ", t)
+		full := path.Join(file, t.Name)
+
+		// DMDIR arrives as the directory mode bit
+		isDir := t.Mode.IsDir()
+
+		// Insert into file tree
+		f, err := srv.File.Insert(full, isDir)
+		if err != nil {
+			t.Rerror("tree insert failed %s", err)
+			return
+		}
+
+		// Upload to blob storage, creating the remote directory if need be
+		// Earlier changes waiting in the journal go first, so this waits too
+		held := journal.holding()
+		if !held {
 			err = f.Blob.Upload(srv.ctx)
-			if err != nil {
-				t.Rerror("azure upload failed %s", err)
-				continue Loop
-			}
+		}
+		if held || journal.offline(err) {
+			f.Blob.Hold()
+			err = journal.record(journalEntry{Op: opCreate, Path: full, IsDir: isDir})
+		}
+		if err != nil {
+			srv.File.Delete(full)
+			t.Rerror("azure upload failed %s", err)
+			return
+		}
 
-			t.Rcreate(f.VF(), nil)
+		f.Blob.opened()
+		t.Rcreate(f.VF(), nil)
 
-		case styx.Tremove:
-			log.Println("=== rm: ", t)
-			full := t.Path()
-			f, err := lookup(*srv, full)
+	case styx.Tremove:
+		log.Println("=== rm: ", t)
+		full := t.Path()
+		if file == "/" {
+			// Removing the root would take the whole share with it
+			t.Rerror("cannot remove the root")
+			return
+		}
+		f, err := lookup(srv, full)
+		if err != nil {
+			t.Rerror("tree walk failed → %s", err)
+			return
+		}
 
-			// Delete from blob storage
-			// TODO - verify delete snapshot options
+		// Delete from blob storage
+		// TODO - verify delete snapshot options
+		held := journal.holding()
+		if held {
+			err = nil
+		} else if f.isDir && *recursive {
+			err = f.Blob.RemoveAll(srv.ctx, full)
+		} else {
 			err = f.Blob.Delete(srv.ctx)
-			if err != nil {
-				t.Rerror("azure delete failed %s", err)
+		}
+		if held || journal.offline(err) {
+			if f.isDir && !*recursive && !f.empty() {
+				// Azure would refuse it on replay, long after we said it was gone
+				t.Rerror("directory not empty")
+				return
+			}
+			err = journal.record(journalEntry{Op: opRemove, Path: file, IsDir: f.isDir, All: *recursive})
+		}
+		if err != nil {
+			if f.isDir {
+				// Some of the contents may be gone, relist on next walk
+				f.forget()
 			}
+			t.Rerror("azure delete failed %s", err)
+			return
+		}
+
+		// Changes to it and anything beneath are moot, and must never be uploaded
+		f.discard()
 
-			// Delete from file tree
-			err = srv.File.Delete(full)
+		// Delete from file tree
+		err = srv.File.Delete(full)
 
-			t.Rremove(err)
+		t.Rremove(err)
 
-		case styx.Ttruncate:
-			// TODO
-			log.Println("=== truncate?: ", t)
+	case styx.Trename:
+		// Name changes through wstat, possibly across directories
+		log.Println("=== rename: ", t)
+		t.Rrename(srv.File.Rename(t.OldPath, t.NewPath))
 
-		case styx.Tutimes:
-			// Change last modified time
-			log.Println("=== utimes?: ", t)
-			// TODO
+	case styx.Ttruncate:
+		log.Println("=== truncate: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rerror("tree walk failed → %s", err)
+			return
+		}
+
+		t.Rtruncate(f.Truncate(t.Size))
+
+	case styx.Tutimes:
+		// Change last modified time, Azure has no access time
+		log.Println("=== utimes: ", t)
+		if t.Mtime.IsZero() {
 			t.Rutimes(nil)
+			return
+		}
 
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rerror("tree walk failed → %s", err)
+			return
 		}
+
+		t.Rutimes(f.SetModTime(t.Mtime))
+
+	case styx.Tsync:
+		// A wstat changing nothing asks for the file to be made durable
+		log.Println("=== sync: ", t)
+		f, err := lookup(srv, file)
+		if err != nil {
+			t.Rerror("tree walk failed → %s", err)
+			return
+		}
+
+		t.Rsync(f.Flush())
+
 	}
 }
 
@@ -7,12 +7,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"errors"
-	"io"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-file-go/azfile"
 )
 
@@ -21,61 +26,290 @@ const (
 	maxBuffers = 3               // Max # rotating buffers for upload
 	bufSize    = 2 * 1024 * 1024 // Rotating buffer size for upload
 	maxRetry   = 20              // Maximum number of retries for download
+
+	copyPoll    = 250 * time.Millisecond // Interval to poll pending server-side copies
+	maxRemovers = 16                     // Maximum deletes in flight for a recursive removal
 )
 
 // Tracks a blob and its state
+// Exported methods take mu, unexported ones expect it to be held
+// The name and URLs change only under both mu and the tree lock
 type Blob struct {
 	// TODO - way to check for changes in Azure
-	name    *string             // Ref to File.name
-	last    time.Time           // Time last accessed by us
-	body    *bytes.Buffer       // Bytes contents of file
-	isDir   bool                // Are we a directory?	TODO - should this be a ptr into the file?
-	tracked bool                // Are we tracking this for synchronization? (were we walked?)
-	fileURL azfile.FileURL      // Azure file object
-	dirURL  azfile.DirectoryURL // Azure directory object
-	parent  azfile.DirectoryURL // Azure directory object parent
+	mu         sync.Mutex          // Guards everything below, bar the atomic flags
+	name       *string             // Ref to File.name
+	last       time.Time           // Time last accessed by us
+	mtime      time.Time           // SMB last write time, zero if unknown
+	mtimeSet   bool                // Was mtime set explicitly, so uploads must keep it?
+	ctime      time.Time           // SMB creation time, zero if unknown
+	size       int64               // Size of the file contents, local or remote
+	etag       azfile.ETag         // Azure entity tag of the version we last saw
+	base       azfile.ETag         // Version our body or chunks came from, changes are judged against it
+	lastMod    time.Time           // HTTP last modified time of that version
+	statted    time.Time           // When mtime, ctime, and etag were fetched, zero once stale
+	loaded     bool                // Does body hold the file contents?
+	body       *bytes.Buffer       // Bytes contents of file
+	dirtySince time.Time           // When body first held changes not yet uploaded
+	pending    bool                // Does body hold journalled changes not yet replayed? It is then the only copy
+	wmode      writeMode           // Mode of the write which dirtied body
+	held       int64               // Bytes of body counted against the memory budget
+	opens      int                 // Open handles, the body is kept while any are
+	chunks     []bool              // Which chunks of body are filled, while read by chunk
+	fetch      map[int64]bool      // Chunks being prefetched
+	next       int64               // Offset a sequential read would continue from
+	ranges     []azfile.Range      // Ranges of the file holding data, the rest are holes
+	rangesOf   azfile.ETag         // Version ranges were listed for
+	isDir      bool                // Are we a directory?	TODO - should this be a ptr into the file?
+	tracked    uint32              // Are we tracking this for synchronization? (were we walked?) - atomic
+	remoteAt   int64               // When last known to exist remotely, unix nanoseconds, zero if never - atomic
+	dirty      uint32              // Does body hold changes not yet uploaded? - atomic
+	fileURL    azfile.FileURL      // Azure file object
+	dirURL     azfile.DirectoryURL // Azure directory object
+	parent     azfile.DirectoryURL // Azure directory object parent
 }
 
 // Self-delete a blob
 // TODO - return more?
 func (b *Blob) Delete(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	if b.isDir {
 		_, err := b.dirURL.Delete(ctx)
 		return err
 	}
-	// Empty files can't be uploaded in the first place
-	// TODO - check if exists remotely first?
-	if len(b.body.Bytes()) < 1 {
-		return nil
-	}
 	_, err := b.fileURL.Delete(ctx)
-	return err
+	if err != nil && !notFound(err) {
+		return err
+	}
+
+	// Never made it to the remote if not found, nothing to delete
+	// Either way, changes not yet uploaded are moot
+	b.setClean()
+	return nil
+}
+
+// Move a blob to name beneath dst
+// The file service API we use has no rename, so we copy server-side then delete
+func (b *Blob) Move(ctx context.Context, dst azfile.DirectoryURL, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log.Println("!!!! MOVING", *b.name, "to", name)
+	if b.isDir {
+		return moveDir(ctx, b.dirURL, dst.NewDirectoryURL(name))
+	}
+
+	return moveFile(ctx, b.fileURL, dst.NewFileURL(name))
+}
+
+// Copy a file server-side, then delete the source once the copy lands
+func moveFile(ctx context.Context, src, dst azfile.FileURL) error {
+	resp, err := dst.StartCopy(ctx, src.URL(), azfile.Metadata{})
+	if err != nil {
+		return errors.New("file copy failed → " + err.Error())
+	}
+
+	status := resp.CopyStatus()
+	for status == azfile.CopyStatusPending {
+		time.Sleep(copyPoll)
+
+		props, err := dst.GetProperties(ctx)
+		if err != nil {
+			return errors.New("file copy status failed → " + err.Error())
+		}
+		status = props.CopyStatus()
+	}
+
+	if status != azfile.CopyStatusSuccess {
+		return errors.New("file copy ended as " + string(status))
+	}
+
+	_, err = src.Delete(ctx)
+	if err != nil {
+		return errors.New("delete after copy failed → " + err.Error())
+	}
+
+	return nil
+}
+
+// Recreate a directory under a new URL, moving its contents, then delete the source
+func moveDir(ctx context.Context, src, dst azfile.DirectoryURL) error {
+	_, err := dst.Create(ctx, azfile.Metadata{}, azfile.SMBProperties{})
+	if err != nil {
+		return errors.New("directory create failed → " + err.Error())
+	}
+
+	files, dirs, err := Ls(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		err = moveFile(ctx, src.NewFileURL(name), dst.NewFileURL(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range dirs {
+		err = moveDir(ctx, src.NewDirectoryURL(name), dst.NewDirectoryURL(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = src.Delete(ctx)
+	if err != nil {
+		return errors.New("delete after move failed → " + err.Error())
+	}
+
+	return nil
+}
+
+// Failures from a recursive removal, by path
+type RemoveError struct {
+	Failed []string // Paths which could not be removed
+	Errs   []error  // Reason for each failure, by index
+}
+
+func (e *RemoveError) Error() string {
+	return fmt.Sprintf("%d entries could not be removed, first %q → %v", len(e.Failed), e.Failed[0], e.Errs[0])
+}
+
+// Remove a blob and, for directories, everything beneath it depth-first
+// Partial failures are reported as a *RemoveError
+func (b *Blob) RemoveAll(ctx context.Context, full string) error {
+	if !b.isDir {
+		return b.Delete(ctx)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r := &remover{
+		ctx: ctx,
+		sem: make(chan struct{}, maxRemovers),
+	}
+
+	r.removeDir(b.dirURL, full)
+	if len(r.err.Failed) > 0 {
+		return &r.err
+	}
+
+	return nil
+}
+
+// State for one recursive removal
+type remover struct {
+	ctx context.Context
+	sem chan struct{} // Bounds the deletes in flight
+	sync.Mutex
+	err RemoveError
+}
+
+// Record a path which could not be removed
+func (r *remover) fail(full string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.err.Failed = append(r.err.Failed, full)
+	r.err.Errs = append(r.err.Errs, err)
+}
+
+// Remove a directory's files in parallel and its sub-directories depth-first
+// Returns whether the directory itself was removed
+func (r *remover) removeDir(dir azfile.DirectoryURL, full string) bool {
+	files, dirs, err := Ls(r.ctx, dir)
+	if err != nil {
+		r.fail(full, err)
+		return false
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	for _, name := range files {
+		wg.Add(1)
+		r.sem <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-r.sem }()
+
+			_, err := dir.NewFileURL(name).Delete(r.ctx)
+			if err != nil && !notFound(err) {
+				atomic.StoreInt32(&failed, 1)
+				r.fail(path.Join(full, name), err)
+			}
+		}(name)
+	}
+
+	// Sub-directories don't hold a slot while their own files are removed
+	ok := true
+	for _, name := range dirs {
+		if !r.removeDir(dir.NewDirectoryURL(name), path.Join(full, name)) {
+			ok = false
+		}
+	}
+
+	wg.Wait()
+	if !ok || atomic.LoadInt32(&failed) != 0 {
+		// Children are already reported, the directory can't go
+		return false
+	}
+
+	_, err = dir.Delete(r.ctx)
+	if err != nil && !notFound(err) {
+		r.fail(full, err)
+		return false
+	}
+
+	return true
+}
+
+// Is the error Azure telling us the resource does not exist?
+func notFound(err error) bool {
+	return strings.Contains(err.Error(), string(azfile.ServiceCodeResourceNotFound))
 }
 
 // List blobs 'in' the current directory, divided into files and sub-directories
-func Ls(ctx context.Context, rootURL azfile.DirectoryURL) (files, dirs []string) {
+func Ls(ctx context.Context, rootURL azfile.DirectoryURL) (files, dirs []string, err error) {
+	fileItems, dirItems, err := List(ctx, rootURL)
+
+	for _, fileEntry := range fileItems {
+		files = append(files, fileEntry.Name)
+	}
+
+	for _, directoryEntry := range dirItems {
+		dirs = append(dirs, directoryEntry.Name)
+	}
+
+	return files, dirs, err
+}
+
+// List blob listing entries 'in' the current directory, these carry file sizes
+func List(ctx context.Context, rootURL azfile.DirectoryURL) (files []azfile.FileItem, dirs []azfile.DirectoryItem, err error) {
 	for marker := (azfile.Marker{}); marker.NotDone(); {
 		// Get a result segment starting with the file indicated by the current Marker.
 		listResponse, err := rootURL.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return files, dirs, errors.New("directory listing failed → " + err.Error())
 		}
 
 		// For next iteration, advance the marker
 		marker = listResponse.NextMarker
 
-		// Files
-		for _, fileEntry := range listResponse.FileItems {
-			files = append(files, fileEntry.Name)
-		}
-
-		// Directories
-		for _, directoryEntry := range listResponse.DirectoryItems {
-			dirs = append(dirs, directoryEntry.Name)
-		}
+		files = append(files, listResponse.FileItems...)
+		dirs = append(dirs, listResponse.DirectoryItems...)
 	}
 
-	return files, dirs
+	return files, dirs, nil
+}
+
+// Size of a file from a listing entry
+func itemSize(item azfile.FileItem) int64 {
+	if item.Properties == nil {
+		return 0
+	}
+	return item.Properties.ContentLength
 }
 
 // Create a new blob
@@ -99,84 +333,652 @@ func NewBlob(name *string, parent azfile.DirectoryURL, isDir bool) *Blob {
 	}
 }
 
-// Return the contents of the body buffer
-func (b Blob) Contents() []byte {
+// Return the contents of the body buffer, the blob lock must be held
+func (b *Blob) Contents() []byte {
 	// TODO - sync with Azure to verify state?
 	return b.body.Bytes()
 }
 
+// Mark a blob as tracked for synchronization
+// The flags are atomic so the tree lock can read them without waiting on transfers
+func (b *Blob) track() {
+	atomic.StoreUint32(&b.tracked, 1)
+}
+
+// Are we tracking this blob for synchronization?
+func (b *Blob) isTracked() bool {
+	return atomic.LoadUint32(&b.tracked) == 1
+}
+
+// Mark a blob as existing remotely, as of now
+func (b *Blob) setRemote() {
+	atomic.StoreInt64(&b.remoteAt, time.Now().UnixNano())
+}
+
+// Do we know the blob exists remotely? Locally created blobs don't until uploaded
+func (b *Blob) isRemote() bool {
+	return atomic.LoadInt64(&b.remoteAt) != 0
+}
+
+// Was the blob known to exist remotely at any point since t?
+func (b *Blob) remoteSince(t time.Time) bool {
+	return atomic.LoadInt64(&b.remoteAt) >= t.UnixNano()
+}
+
 // Upload a blob in full
 func (b *Blob) Upload(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.upload(ctx)
+}
+
+// Upload a blob in full
+func (b *Blob) upload(ctx context.Context) error {
 	log.Println("!!!! UPLOADING ", *b.name)
-	size := int64(len(b.body.Bytes()))
-	if size < 1 && !b.isDir {
-		// Can't upload empty files
-		return nil
-	}
 
 	if b.isDir {
 		_, err := b.dirURL.Create(ctx, azfile.Metadata{}, azfile.SMBProperties{})
 		// Check if exists remotely?
+		if err == nil {
+			b.setRemote()
+		}
 		return err
 	}
 
+	// Someone else may have changed it since we fetched our version
+	err := b.precondition(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.statted = time.Time{}
+	var mtime time.Time
+	if b.mtimeSet {
+		mtime = b.mtime
+	}
+	etag, lastMod, err := putFile(ctx, b.fileURL, b.body.Bytes(), mtime)
+	if err != nil {
+		return err
+	}
+	b.setRemote()
+	b.loaded = true
+	b.setClean()
+	b.setVersion(etag, lastMod)
+	b.base = etag
+	b.toCache()
+
+	return nil
+}
+
+// Upload any changes not yet sent to Azure
+func (b *Blob) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush(ctx)
+}
+
+// Upload any changes not yet sent to Azure
+func (b *Blob) flush(ctx context.Context) error {
+	if !b.isDirty() {
+		return nil
+	}
+	if journal.holding() {
+		// Must go after the changes in the journal, which wait for Azure
+		return errors.New("changes held until Azure is reachable")
+	}
+
+	log.Println("!!!! FLUSHING", *b.name)
+	return b.upload(ctx)
+}
+
+// Create a file in full from data, returning the version we made
+// The file carries the MD5 of data, and each range the MD5 of its part so Azure refuses corrupted ones
+// A non-zero mtime is kept as the SMB last write time, rather than the time of the upload
+func putFile(ctx context.Context, url azfile.FileURL, data []byte, mtime time.Time) (azfile.ETag, time.Time, error) {
+	size := int64(len(data))
+	sum := md5.Sum(data)
+
 	// Trigger a create
-	_, err := b.fileURL.Create(ctx, size, azfile.FileHTTPHeaders{ContentType: "text/plain"}, azfile.Metadata{})
+	headers := azfile.FileHTTPHeaders{ContentType: "text/plain", ContentMD5: sum[:]}
+	if !mtime.IsZero() {
+		headers.SMBProperties.FileLastWriteTime = &mtime
+	}
+	created, err := url.Create(ctx, size, headers, azfile.Metadata{})
 	if err != nil {
 		// Check azfile.ServiceCodeResourceAlreadyExists ?
+		return azfile.ETagNone, time.Time{}, err
+	}
+	etag, lastMod := created.ETag(), created.LastModified()
+
+	// Empty ranges can't be uploaded, an empty file needs only the create
+	for off := int64(0); off < size; off += maxRange {
+		end := off + maxRange
+		if end > size {
+			end = size
+		}
+
+		part := data[off:end]
+		partSum := md5.Sum(part)
+		uploaded, err := url.UploadRange(ctx, off, bytes.NewReader(part), partSum[:])
+		if err != nil {
+			return azfile.ETagNone, time.Time{}, err
+		}
+		etag, lastMod = uploaded.ETag(), uploaded.LastModified()
+	}
+
+	// Writing ranges moves the last write time on, so set it again
+	if !mtime.IsZero() && size > 0 {
+		set, err := url.SetHTTPHeaders(ctx, headers)
+		if err != nil {
+			return azfile.ETagNone, time.Time{}, errors.New("file set headers failed → " + err.Error())
+		}
+		etag, lastMod = set.ETag(), set.LastModified()
+	}
+
+	return etag, lastMod, nil
+}
+
+// A write lost the race with a change made elsewhere
+type ConflictError struct {
+	Name    string      // File we were writing
+	Want    azfile.ETag // Version our changes were based on
+	Got     azfile.ETag // Version found remotely
+	Copy    string      // Name our changes were saved under, if saved
+	CopyErr error       // Why saving a conflict copy failed, if it did
+}
+
+func (e *ConflictError) Error() string {
+	s := fmt.Sprintf("conflict: %q changed remotely (have version %s, found %s)", e.Name, e.Want, e.Got)
+	if e.Copy != "" {
+		s += fmt.Sprintf(", local changes saved as %q", e.Copy)
+	}
+	if e.CopyErr != nil {
+		s += ", saving local changes failed → " + e.CopyErr.Error()
+	}
+	return s
+}
+
+// Check the remote is still the version our body is based on
+// The file API has no conditional writes, so a window remains between check and upload
+func (b *Blob) precondition(ctx context.Context) error {
+	if b.base == azfile.ETagNone || !b.isRemote() {
+		return nil
+	}
+
+	props, err := b.fileURL.GetProperties(ctx)
+	if err != nil {
+		if notFound(err) {
+			// Deleted remotely, writing recreates it
+			return nil
+		}
+		return errors.New("file get properties failed → " + err.Error())
+	}
+
+	if props.ETag() == b.base {
+		return nil
+	}
+
+	conflict := &ConflictError{
+		Name: *b.name,
+		Want: b.base,
+		Got:  props.ETag(),
+	}
+
+	if *conflictCopy {
+		conflict.Copy, conflict.CopyErr = b.saveConflictCopy(ctx)
+	}
+
+	// Our body no longer reflects the remote, fetch theirs next time
+	// Unsent changes are given up on, kept only in a conflict copy if asked for
+	b.loaded = false
+	b.chunks = nil
+	b.setClean()
+
+	return conflict
+}
+
+// Save the body beside the file under a conflict name, returning that name
+func (b *Blob) saveConflictCopy(ctx context.Context) (string, error) {
+	name := *b.name + ".conflict-" + time.Now().UTC().Format("20060102T150405Z")
+	log.Println("!!!! SAVING CONFLICT COPY", name)
+
+	_, _, err := putFile(ctx, b.parent.NewFileURL(name), b.body.Bytes(), time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Truncate or extend a blob to size bytes, new bytes read as zero
+func (b *Blob) Truncate(ctx context.Context, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isDir {
+		return errors.New("cannot truncate a directory")
+	}
+	if size < 0 {
+		return errors.New("negative truncate size")
+	}
+	if tooBig(size) {
+		return errTooBig
+	}
+
+	log.Println("!!!! TRUNCATING", *b.name, "to", size)
+
+	// Keeping a prefix of the file means we need the prefix
+	if size > 0 {
+		err := b.load(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The remote is resized in place, so it needs our changes first
+	err := b.flush(ctx)
+	if err != nil {
 		return err
 	}
 
-	_, err = b.fileURL.UploadRange(ctx, 0, bytes.NewReader(b.body.Bytes()), nil)
+	// The prefix we keep must be of the version Azure holds, not one replaced since we loaded it
+	if size > 0 {
+		err = b.precondition(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	resized, err := b.fileURL.Resize(ctx, size)
+	if err != nil {
+		if !notFound(err) {
+			return errors.New("file resize failed → " + err.Error())
+		}
 
-	return err
+		// Not created remotely yet, create at the requested size
+		created, err := b.fileURL.Create(ctx, size, azfile.FileHTTPHeaders{ContentType: "text/plain"}, azfile.Metadata{})
+		if err != nil {
+			return errors.New("file create failed → " + err.Error())
+		}
+		b.setVersion(created.ETag(), created.LastModified())
+	} else {
+		b.setVersion(resized.ETag(), resized.LastModified())
+	}
+
+	resize(b.body, int(size))
+	b.account()
+	b.size = size
+	b.mtimeSet = false
+	b.statted = time.Time{}
+	b.loaded = true
+	b.chunks = nil
+	b.base = b.etag
+	b.setRemote()
+
+	// The stored MD5 is of the old contents
+	return b.putMD5(ctx)
 }
 
-// Download a blob in full
-func (b *Blob) Download(ctx context.Context) error {
+// Set the Content-MD5 of the file to that of the body
+func (b *Blob) putMD5(ctx context.Context) error {
+	// Setting headers replaces all of them, so carry over the existing ones
+	resp, err := b.fileURL.GetProperties(ctx)
+	if err != nil {
+		return errors.New("file get properties failed → " + err.Error())
+	}
+
+	if resp.ETag() != b.base {
+		// Changed again since we resized it, so our body is no longer its contents
+		log.Println("!!!! CHANGED REMOTELY", *b.name)
+		b.loaded = false
+		return nil
+	}
+
+	headers := resp.NewHTTPHeaders()
+	sum := md5.Sum(b.body.Bytes())
+	headers.ContentMD5 = sum[:]
+	set, err := b.fileURL.SetHTTPHeaders(ctx, headers)
+	if err != nil {
+		return errors.New("file set headers failed → " + err.Error())
+	}
+	b.setVersion(set.ETag(), set.LastModified())
+	b.base = b.etag
+
+	return nil
+}
+
+// Set the SMB last write time of a blob
+func (b *Blob) SetModTime(ctx context.Context, t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log.Println("!!!! SETTING MTIME", *b.name, "to", t)
+	props := azfile.SMBProperties{FileLastWriteTime: &t}
+
 	if b.isDir {
+		_, err := b.dirURL.SetProperties(ctx, props)
+		if err != nil {
+			return errors.New("directory set properties failed → " + err.Error())
+		}
+		b.mtime = t
 		return nil
 	}
-	log.Println("!!!! DOWNLOADING", *b.name)
-	resp, err := b.fileURL.Download(context.Background(), 0, azfile.CountToEnd, false)
+
+	// Setting headers replaces all of them, so carry over the existing ones
+	resp, err := b.fileURL.GetProperties(ctx)
 	if err != nil {
-		return errors.New("file download failed → " + err.Error())
+		return errors.New("file get properties failed → " + err.Error())
+	}
+
+	headers := resp.NewHTTPHeaders()
+	headers.SMBProperties = props
+	set, err := b.fileURL.SetHTTPHeaders(ctx, headers)
+	if err != nil {
+		return errors.New("file set headers failed → " + err.Error())
+	}
+	b.mtime = t
+	b.mtimeSet = true
+	b.setVersion(set.ETag(), set.LastModified())
+
+	// The new version is ours only if nobody else made one since our body's
+	if resp.ETag() == b.base {
+		b.base = b.etag
 	}
 
-	contentLength := resp.ContentLength()
-	opts := azfile.RetryReaderOptions{MaxRetryRequests: 3}
-	retryReader := resp.Body(opts)
+	return nil
+}
+
+// Write p into the body at off, growing the body with zeros as needed
+func (b *Blob) writeAt(p []byte, off int64) {
+	end := int(off) + len(p)
+	if end > b.body.Len() {
+		resize(b.body, end)
+	}
+
+	copy(b.body.Bytes()[off:], p)
+	b.size = int64(b.body.Len())
+	b.account()
 
-	// NewResponseBodyStream wraps the RetryReader with progress reporting; it returns an io.ReadCloser.
-	progressReader := pipeline.NewResponseBodyProgress(retryReader,
-		func(bytesTransferred int64) {
-			log.Printf("!!!!» Downloaded %d of %d bytes.\n", bytesTransferred, contentLength)
-		})
-	defer progressReader.Close() // The client must close the response body when finished with it
+	// Written now, so the upload takes the time it happens at
+	b.mtimeSet = false
+}
 
-	// Copy the body into a buffer
-	log.Println("! readfrom")
+// Replace the body wholesale, such as to undo a change
+func (b *Blob) setBody(p []byte) {
 	b.body.Reset()
-	written, err := io.CopyN(b.body, progressReader, contentLength) // Write to the file by reading from the file (with intelligent retries).
+	b.body.Write(p)
+	b.size = int64(len(p))
+	b.account()
+}
+
+// Shrink or zero-extend a buffer to exactly size bytes
+func resize(buf *bytes.Buffer, size int) {
+	if size <= buf.Len() {
+		buf.Truncate(size)
+		return
+	}
+
+	buf.Write(make([]byte, size-buf.Len()))
+}
+
+// Download a blob in full, unless we already hold its contents
+func (b *Blob) Load(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.load(ctx)
+}
+
+// Download a blob in full, unless we already hold its contents
+func (b *Blob) load(ctx context.Context) error {
+	b.last = time.Now()
+	if b.loaded {
+		return nil
+	}
+	return b.download(ctx)
+}
+
+// Download a blob in full
+func (b *Blob) Download(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.download(ctx)
+}
+
+// Download a blob in full
+func (b *Blob) download(ctx context.Context) error {
+	if b.isDir || b.isDirty() || b.pending {
+		// Our unsent changes are newer than anything remote
+		return nil
+	}
+	b.last = time.Now()
+
+	// File reads take no If-None-Match, so learn the ETag first
+	// A stat within the attribute TTL, such as the one open just made, is reused
+	// It drops what we hold if it changed, and leaves the remote size while we hold nothing
+	if !b.fresh() {
+		err := b.stat(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Huge files are only ever streamed, holding them could exhaust memory
+	if !b.loaded && b.chunks == nil && tooBig(b.size) {
+		return errTooBig
+	}
+
+	// If the version we hold is current there is nothing to fetch
+	if b.loaded && b.base != azfile.ETagNone && b.base == b.etag {
+		log.Println("!!!! UNCHANGED", *b.name)
+		return nil
+	}
+
+	// A previous fetch of this version may still be on disk
+	if b.chunks == nil && diskCache != nil && b.fromCache(b.etag, b.size) {
+		log.Println("!!!! CACHED", *b.name)
+		return nil
+	}
+
+	// Large files are fetched by chunk in parallel, resuming from any chunks we hold
+	if b.chunks == nil && b.size > *chunkSize {
+		b.startChunks()
+	}
+	if b.chunks != nil {
+		log.Println("!!!! DOWNLOADING BY CHUNK", *b.name)
+		return b.fill(ctx, 0, b.size)
+	}
+
+	log.Println("!!!! DOWNLOADING", *b.name)
+
+	// Small enough for one range, which Azure sends the MD5 of
+	// The MD5 stored with the file is not checked, writes over SMB leave it stale
+	for retried := false; ; retried = true {
+		p := make([]byte, b.size)
+		got := b.etag
+		if len(p) > 0 {
+			var err error
+			got, err = getRange(ctx, b.fileURL, 0, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		if got == b.etag {
+			b.setBody(p)
+			b.base = b.etag
+			b.loaded = true
+			b.toCache()
+			return nil
+		}
+		if retried {
+			return errChanged
+		}
+
+		// Changed since we looked, so pick up the new size
+		err := b.stat(ctx)
+		if err != nil {
+			return err
+		}
+		if b.size > *chunkSize {
+			b.startChunks()
+			return b.fill(ctx, 0, b.size)
+		}
+	}
+}
+
+// Key of the blob in the disk cache, stable across runs
+func (b *Blob) cacheKey() string {
+	u := b.fileURL.URL()
+	return u.Host + u.Path
+}
+
+// Fill the body with a version of the blob held in the disk cache
+// Returns whether every chunk of that version was held
+func (b *Blob) fromCache(etag azfile.ETag, size int64) bool {
+	if etag == azfile.ETagNone {
+		return false
+	}
+
+	key := b.cacheKey()
+	buf := make([]byte, size)
+	for off := int64(0); off < size; off += *chunkSize {
+		end := off + *chunkSize
+		if end > size {
+			end = size
+		}
+		if !diskCache.Get(key, etag, off / *chunkSize, buf[off:end]) {
+			return false
+		}
+	}
+
+	b.setBody(buf)
+	b.loaded = true
+	b.base = etag
+
+	return true
+}
+
+// Save the contents we hold of the current version to the disk cache, if enabled
+func (b *Blob) toCache() {
+	if diskCache == nil || !b.loaded || b.base == azfile.ETagNone {
+		return
+	}
+
+	key := b.cacheKey()
+	data := b.body.Bytes()
+	for off := int64(0); off < int64(len(data)); off += *chunkSize {
+		end := off + *chunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		diskCache.Put(key, b.base, off / *chunkSize, data[off:end])
+	}
+}
+
+// Acquire information about a blob without downloading its contents
+func (b *Blob) Stat(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stat(ctx)
+}
+
+// Acquire information about a blob without downloading its contents
+func (b *Blob) stat(ctx context.Context) error {
+	if b.isDir {
+		resp, err := b.dirURL.GetProperties(ctx)
+		if err != nil {
+			return errors.New("directory get properties failed → " + err.Error())
+		}
+
+		b.mtime = parseTime(resp.FileLastWriteTime(), resp.LastModified())
+		b.ctime = parseTime(resp.FileCreationTime(), time.Time{})
+		b.setVersion(resp.ETag(), resp.LastModified())
+		b.statted = time.Now()
+		return nil
+	}
+
+	resp, err := b.fileURL.GetProperties(ctx)
 	if err != nil {
-		return errors.New("copy to body failed → " + err.Error())
+		return errors.New("file get properties failed → " + err.Error())
+	}
+
+	// Someone else changed it, what we hold is out of date
+	// Unsent changes are kept, uploading them reports the conflict
+	if (b.loaded || b.chunks != nil) && !b.isDirty() && !b.pending && b.base != azfile.ETagNone && resp.ETag() != b.base {
+		log.Println("!!!! CHANGED REMOTELY", *b.name)
+		b.loaded = false
+		b.chunks = nil
+	}
+
+	// Moved by a rename, the unchanged body we hold is the copy's first version
+	if (b.loaded || b.chunks != nil) && !b.isDirty() && !b.pending && b.base == azfile.ETagNone {
+		b.base = resp.ETag()
 	}
 
-	log.Println("!!!!» Copied: ", written)
+	if !b.loaded && b.chunks == nil {
+		// Our contents are the authority on size once we hold them
+		b.size = resp.ContentLength()
+	}
+	b.mtime = parseTime(resp.FileLastWriteTime(), resp.LastModified())
+	b.ctime = parseTime(resp.FileCreationTime(), time.Time{})
+	b.setVersion(resp.ETag(), resp.LastModified())
+	b.statted = time.Now()
 
-	return err
+	return nil
 }
 
-// Acquire information about a blob
-func (b *Blob) Stat() error {
-	/*
-		ctx := context.Background()
-		resp, err := b.fileURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+// Check data against the MD5 Azure sent with it
+// With none sent there is nothing to check, which is an error only under -verifymd5
+func checkMD5(want, data []byte) error {
+	if len(want) == 0 {
+		if *verifyMD5 {
+			return errors.New("no content MD5 to verify against")
+		}
+		return nil
+	}
 
-		log.Println("» Stat Resp → ", *resp.Response(), " err → ", err)
-		log.Println("» Type → ", resp.BlobType())
-	*/
+	got := md5.Sum(data)
+	if !bytes.Equal(want, got[:]) {
+		return errors.New("content MD5 mismatch, corrupted in transit")
+	}
 
-	// TODO - make some kind of FileInfo or similar?
 	return nil
 }
+
+// Note the remote version of the blob from a response which carried it
+// The base our body came from moves only where the body is fetched or uploaded
+func (b *Blob) setVersion(etag azfile.ETag, lastMod time.Time) {
+	b.etag = etag
+	b.lastMod = lastMod
+}
+
+// A qid version for the blob, derived from its ETag so it changes when the contents do
+// Zero while the version is unknown
+func (b *Blob) version() uint32 {
+	if b.etag == azfile.ETagNone {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(b.etag))
+	return h.Sum32()
+}
+
+// Are the cached properties within the attribute TTL?
+func (b *Blob) fresh() bool {
+	return !b.statted.IsZero() && time.Since(b.statted) < *attrTTL
+}
+
+// Parse an SMB property time string, using fallback if it is absent or malformed
+func parseTime(s string, fallback time.Time) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
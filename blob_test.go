@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+// A share holding one file, whose version moves on with every change made to it
+type fakeFile struct {
+	mu      sync.Mutex
+	etag    int      // Version the file is at
+	changes []string // Requests which would have changed it
+}
+
+// Serve properties, and accept any change by moving to a new version
+func (ff *fakeFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	if r.Method != http.MethodHead && r.Method != http.MethodGet {
+		ff.changes = append(ff.changes, r.Method+" "+r.URL.RawQuery)
+		ff.etag++
+	}
+	w.Header().Set("ETag", ff.version())
+	w.WriteHeader(http.StatusOK)
+}
+
+// The ETag of the current version
+func (ff *fakeFile) version() string {
+	return fmt.Sprintf(`"v%d"`, ff.etag)
+}
+
+// A blob for file f of a share served by ff, holding body as version base
+func fakeBlob(t *testing.T, ff *fakeFile, body string, base azfile.ETag) *Blob {
+	server := httptest.NewServer(ff)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL + "/share")
+	root := azfile.NewDirectoryURL(*u, azfile.NewPipeline(azfile.NewAnonymousCredential(), azfile.PipelineOptions{}))
+
+	name := "f"
+	b := NewBlob(&name, root, false)
+	b.fileURL = root.NewFileURL(name)
+	b.setBody([]byte(body))
+	b.loaded = true
+	b.setVersion(base, b.lastMod)
+	b.base = base
+	b.setRemote()
+
+	return b
+}
+
+// Truncating a body someone else replaced must not write it back over theirs
+func TestTruncateConflict(t *testing.T) {
+	ff := &fakeFile{etag: 2}
+	b := fakeBlob(t, ff, "hello", `"v1"`)
+
+	err := b.Truncate(context.Background(), 2)
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("truncate of a stale body gave %v", err)
+	}
+	if len(ff.changes) != 0 {
+		t.Errorf("changed the remote → %v", ff.changes)
+	}
+	if b.loaded || b.base != `"v1"` {
+		t.Errorf("stale body kept, loaded %v at %s", b.loaded, b.base)
+	}
+}
+
+// Truncating a current body moves our base to the version we made
+func TestTruncateCurrent(t *testing.T) {
+	ff := &fakeFile{etag: 1}
+	b := fakeBlob(t, ff, "hello", `"v1"`)
+
+	err := b.Truncate(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Contents()) != "he" {
+		t.Errorf("body is %q, want %q", b.Contents(), "he")
+	}
+	if want := azfile.ETag(ff.version()); b.base != want || b.etag != want {
+		t.Errorf("at base %s, etag %s, want %s", b.base, b.etag, want)
+	}
+}
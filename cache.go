@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// On-disk cache of file contents, held as fixed-size chunks
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+const (
+	maxRange  = 4 * 1024 * 1024 // Largest range Azure takes in one upload, and so the largest chunk
+	tmpSuffix = ".tmp"          // Suffix of chunk files still being written
+)
+
+// Chunks are named <hash of url, etag, and chunk size>-<chunk index>, so the directory is the index
+// A new version of a file has a new ETag, so stale chunks are never read and age out
+type DiskCache struct {
+	dir     string                   // Directory holding chunk files
+	max     int64                    // Maximum bytes held
+	mu      sync.Mutex               // Guards everything below
+	used    int64                    // Bytes held
+	entries map[string]*list.Element // Chunk name → entry in lru
+	lru     *list.List               // Of *cacheEntry, most recently used at the front
+}
+
+// One chunk file
+type cacheEntry struct {
+	name string // File name within the cache directory
+	size int64  // Bytes in the chunk
+}
+
+// The disk cache in use, nil if disabled
+var diskCache *DiskCache
+
+// Open a cache directory, recovering any chunks a previous run left behind
+func NewDiskCache(dir string, max int64) (*DiskCache, error) {
+	if max < *chunkSize {
+		return nil, fmt.Errorf("cache size must be at least one %d byte chunk", *chunkSize)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.New("could not make cache directory → " + err.Error())
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	err = c.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Rebuild the index from the chunk files on disk, oldest access last
+func (c *DiskCache) recover() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return errors.New("could not read cache directory → " + err.Error())
+	}
+
+	// Access times are kept as modification times
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+
+		// Interrupted writes are never valid chunks
+		if strings.HasSuffix(name, tmpSuffix) {
+			os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+
+		c.entries[name] = c.lru.PushBack(&cacheEntry{name: name, size: info.Size()})
+		c.used += info.Size()
+	}
+
+	log.Printf("Recovered %d cached chunks, %d bytes\n", len(c.entries), c.used)
+	c.evict()
+
+	return nil
+}
+
+// Name of the chunk file for a chunk of a version of a file
+func chunkName(url string, etag azfile.ETag, index int64) string {
+	sum := sha256.Sum256([]byte(url + "\x00" + string(etag) + "\x00" + strconv.FormatInt(*chunkSize, 10)))
+	return hex.EncodeToString(sum[:]) + "-" + strconv.FormatInt(index, 10)
+}
+
+// Read a chunk into p, which must be the chunk's exact length
+// Returns whether the chunk was cached
+func (c *DiskCache) Get(url string, etag azfile.ETag, index int64, p []byte) bool {
+	name := chunkName(url, etag, index)
+
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+	if !ok || elem.Value.(*cacheEntry).size != int64(len(p)) {
+		c.mu.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	full := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(full)
+	if err != nil || len(data) != len(p) {
+		c.drop(name)
+		return false
+	}
+	copy(p, data)
+
+	// Remember the access for recovery
+	now := time.Now()
+	os.Chtimes(full, now, now)
+
+	return true
+}
+
+// Store a chunk, evicting the least recently used chunks to stay in budget
+func (c *DiskCache) Put(url string, etag azfile.ETag, index int64, data []byte) {
+	if etag == azfile.ETagNone {
+		// Can't tell versions apart, so can't cache
+		return
+	}
+
+	name := chunkName(url, etag, index)
+	full := filepath.Join(c.dir, name)
+
+	// Write aside and rename, so a crash never leaves a partial chunk under a valid name
+	err := ioutil.WriteFile(full+tmpSuffix, data, 0600)
+	if err == nil {
+		err = os.Rename(full+tmpSuffix, full)
+	}
+	if err != nil {
+		log.Println("cache write of", name, "failed →", err)
+		os.Remove(full + tmpSuffix)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		entry := elem.Value.(*cacheEntry)
+		c.used += int64(len(data)) - entry.size
+		entry.size = int64(len(data))
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, size: int64(len(data))})
+		c.used += int64(len(data))
+	}
+
+	c.evict()
+}
+
+// Forget a chunk which turned out to be unreadable
+func (c *DiskCache) drop(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		c.remove(elem)
+	}
+}
+
+// Evict least recently used chunks until within budget, the lock must be held
+func (c *DiskCache) evict() {
+	for c.used > c.max {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+// Remove a chunk from the index and disk, the lock must be held
+func (c *DiskCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.name)
+	c.used -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.name))
+}
+
+// Bytes currently held
+func (c *DiskCache) Used() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.used
+}
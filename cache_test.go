@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+const testURL = "account.file.core.windows.net/share/f"
+
+// Use small chunks for the length of a test
+func smallChunks(t *testing.T) {
+	old := *chunkSize
+	*chunkSize = 16
+	t.Cleanup(func() { *chunkSize = old })
+}
+
+// Chunks come back only for the version and length they were stored under
+func TestDiskCacheGetPut(t *testing.T) {
+	smallChunks(t)
+	c, err := NewDiskCache(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("0123456789abcdef")
+	c.Put(testURL, "v1", 0, data)
+	c.Put(testURL, azfile.ETagNone, 1, data)
+
+	p := make([]byte, len(data))
+	if !c.Get(testURL, "v1", 0, p) || !bytes.Equal(p, data) {
+		t.Errorf("chunk 0 of v1 read back as %q", p)
+	}
+	if c.Get(testURL, "v2", 0, p) {
+		t.Error("read chunk 0 of a version never stored")
+	}
+	if c.Get(testURL, azfile.ETagNone, 1, p) {
+		t.Error("stored a chunk without a version")
+	}
+	if c.Get(testURL, "v1", 0, p[:8]) {
+		t.Error("read a chunk into a buffer of the wrong length")
+	}
+	if c.Used() != int64(len(data)) {
+		t.Errorf("using %d bytes, want %d", c.Used(), len(data))
+	}
+}
+
+// Least recently used chunks go first once over budget
+func TestDiskCacheEvict(t *testing.T) {
+	smallChunks(t)
+	c, err := NewDiskCache(t.TempDir(), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 16)
+	p := make([]byte, 16)
+	c.Put(testURL, "v1", 0, data)
+	c.Put(testURL, "v1", 1, data)
+	c.Get(testURL, "v1", 0, p)
+	c.Put(testURL, "v1", 2, data)
+
+	if c.Get(testURL, "v1", 1, p) {
+		t.Error("least recently used chunk survived")
+	}
+	if !c.Get(testURL, "v1", 0, p) || !c.Get(testURL, "v1", 2, p) {
+		t.Error("recently used chunk evicted")
+	}
+	if c.Used() != 32 {
+		t.Errorf("using %d bytes, want 32", c.Used())
+	}
+
+	names, _ := filepath.Glob(filepath.Join(c.dir, "*"))
+	if len(names) != 2 {
+		t.Errorf("%d chunk files on disk, want 2", len(names))
+	}
+}
+
+// A restart keeps chunks in access order and removes interrupted writes
+func TestDiskCacheRecover(t *testing.T) {
+	smallChunks(t)
+	dir := t.TempDir()
+
+	// Written oldest first, as a previous run would have left them
+	now := time.Now()
+	for i, index := range []int64{0, 1, 2} {
+		full := filepath.Join(dir, chunkName(testURL, "v1", index))
+		err := ioutil.WriteFile(full, make([]byte, 16), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(time.Duration(i-3) * time.Minute)
+		os.Chtimes(full, at, at)
+	}
+	torn := filepath.Join(dir, chunkName(testURL, "v1", 3)+tmpSuffix)
+	err := ioutil.WriteFile(torn, make([]byte, 5), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only room for two, so the oldest goes
+	c, err := NewDiskCache(dir, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Error("torn chunk left on disk")
+	}
+	p := make([]byte, 16)
+	if c.Get(testURL, "v1", 0, p) {
+		t.Error("oldest chunk survived recovery")
+	}
+	if !c.Get(testURL, "v1", 1, p) || !c.Get(testURL, "v1", 2, p) {
+		t.Error("newer chunks lost in recovery")
+	}
+	if c.Used() != 32 {
+		t.Errorf("using %d bytes, want 32", c.Used())
+	}
+}
+
+// A chunk file gone from under us is dropped, not served
+func TestDiskCacheMissingFile(t *testing.T) {
+	smallChunks(t)
+	c, err := NewDiskCache(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put(testURL, "v1", 0, make([]byte, 16))
+	os.Remove(filepath.Join(c.dir, chunkName(testURL, "v1", 0)))
+
+	if c.Get(testURL, "v1", 0, make([]byte, 16)) {
+		t.Error("read a chunk whose file is gone")
+	}
+	if c.Used() != 0 {
+		t.Errorf("using %d bytes, want 0", c.Used())
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Indexed children of a directory File
+package main
+
+// Children of a directory, indexed by name and listed in insertion order
+// Removal leaves a hole in the order which is compacted away once holes dominate
+type childSet struct {
+	index map[string]int // Name → position in order
+	order []*File        // Insertion order, nil where a child was removed
+	holes int            // Number of nil entries in order
+}
+
+// Number of children
+func (c *childSet) len() int {
+	return len(c.index)
+}
+
+// Child by name, nil if absent
+func (c *childSet) get(name string) *File {
+	i, ok := c.index[name]
+	if !ok {
+		return nil
+	}
+	return c.order[i]
+}
+
+// Add a child, replacing any child of the same name in place
+func (c *childSet) add(f *File) {
+	if c.index == nil {
+		c.index = make(map[string]int)
+	}
+
+	if i, ok := c.index[f.name]; ok {
+		c.order[i] = f
+		return
+	}
+
+	c.index[f.name] = len(c.order)
+	c.order = append(c.order, f)
+}
+
+// Remove a child by name, returning it or nil if absent
+func (c *childSet) remove(name string) *File {
+	i, ok := c.index[name]
+	if !ok {
+		return nil
+	}
+
+	f := c.order[i]
+	delete(c.index, name)
+	c.order[i] = nil
+	c.holes++
+
+	if c.holes > len(c.order)/2 {
+		c.compact()
+	}
+
+	return f
+}
+
+// Squeeze the holes out of the order, re-indexing what remains
+func (c *childSet) compact() {
+	order := make([]*File, 0, len(c.index))
+	for _, f := range c.order {
+		if f == nil {
+			continue
+		}
+		c.index[f.name] = len(order)
+		order = append(order, f)
+	}
+
+	c.order = order
+	c.holes = 0
+}
+
+// Call fn on each child in order
+func (c *childSet) each(fn func(*File)) {
+	for _, f := range c.order {
+		if f != nil {
+			fn(f)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Names of the children in order
+func childNames(c *childSet) []string {
+	var names []string
+	c.each(func(f *File) {
+		names = append(names, f.name)
+	})
+	return names
+}
+
+func TestChildSet(t *testing.T) {
+	var c childSet
+	if c.get("a") != nil || c.remove("a") != nil || c.len() != 0 {
+		t.Fatal("empty set holds something")
+	}
+
+	for i := 0; i < 10; i++ {
+		c.add(&File{name: fmt.Sprint(i)})
+	}
+	if c.len() != 10 {
+		t.Fatalf("len %d, want 10", c.len())
+	}
+
+	// Replacing keeps the position
+	three := &File{name: "3"}
+	c.add(three)
+	if c.get("3") != three || c.len() != 10 {
+		t.Error("replace did not take the old child's place")
+	}
+
+	// Removing more than half compacts, order and index must survive it
+	for _, name := range []string{"0", "2", "4", "6", "8", "9"} {
+		if c.remove(name) == nil {
+			t.Errorf("remove %q found nothing", name)
+		}
+	}
+	if c.holes != 0 || len(c.order) != c.len() {
+		t.Errorf("not compacted, %d holes in %d", c.holes, len(c.order))
+	}
+
+	want := []string{"1", "3", "5", "7"}
+	got := childNames(&c)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+	for _, name := range want {
+		if f := c.get(name); f == nil || f.name != name {
+			t.Errorf("get %q after compaction gave %v", name, f)
+		}
+	}
+	if c.get("3") != three {
+		t.Error("replaced child lost in compaction")
+	}
+
+	// Added after compaction goes last
+	c.add(&File{name: "0"})
+	got = childNames(&c)
+	if got[len(got)-1] != "0" {
+		t.Errorf("order %v, want 0 last", got)
+	}
+}
+
+// A set of n children named by number
+func bigChildSet(n int) *childSet {
+	c := &childSet{}
+	for i := 0; i < n; i++ {
+		c.add(&File{name: fmt.Sprint(i)})
+	}
+	return c
+}
+
+func BenchmarkChildGet(b *testing.B) {
+	c := bigChildSet(1000000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if c.get(fmt.Sprint(i%1000000)) == nil {
+			b.Fatal("child missing")
+		}
+	}
+}
+
+func BenchmarkChildEach(b *testing.B) {
+	c := bigChildSet(1000000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n := 0
+		c.each(func(*File) { n++ })
+		if n != 1000000 {
+			b.Fatal("children missing")
+		}
+	}
+}
@@ -14,42 +14,59 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
 )
 
 const (
-	maxChildren = 32     // Maxmimum number of children a directory can have
 	maxProtoBuf = 256    // Maximum size of the buffer for storing directory contents
-	infoBuf     = 10     // Buffer size for file info
 	uid         = "none" // User ID
 	gid         = "none" // Group ID
 	muid        = "none" // (last Modified) User ID
 )
 
+// Azure-specific file information, returned by Sys()
+type SysInfo struct {
+	Ctime        time.Time // SMB creation time
+	ETag         string    // Azure entity tag
+	LastModified time.Time // HTTP last modified time, bumped by any change
+	Version      uint32    // Qid version, changes with the ETag
+}
+
 // Represents a file in the file system
+// The parent, name, children, and listed fields are guarded by srv.tree
 type File struct {
-	parent   *File            // Parent directory
-	srv      *Server          // Server we run under (could be global?)
-	name     string           // Name of the file singleton `/f/a` is `a`
-	isDir    bool             // Are we a directory?
-	last     time.Time        // Last modified time
-	*Blob                     // Some kind of contents to the file
-	Children []*File          // Our child nodes (if a directory)
-	info     chan os.FileInfo // Info channel for Readdir()
+	parent   *File     // Parent directory
+	srv      *Server   // Server we run under (could be global?)
+	name     string    // Name of the file singleton `/f/a` is `a`
+	isDir    bool      // Are we a directory? Never changes for a node
+	last     time.Time // Last modified time
+	*Blob              // Some kind of contents to the file
+	children childSet  // Our child nodes (if a directory)
+	listed   time.Time // When children were last listed from the remote
+	added    time.Time // When the node joined the tree
+}
+
+// Position of one open handle within a directory listing - See: vfile.go
+type dirCursor struct {
+	sync.Mutex
+	entries []os.FileInfo // Snapshot of the listing, nil until a pass starts
+	pos     int           // Index of the next entry to return
 }
 
-// Creates a VFile out of a File - See: vfile.go
+// Creates a VFile out of a File, with its own directory cursor - See: vfile.go
 func (f *File) VF() VFile {
-	return VFile{f}
+	return VFile{f, &dirCursor{}}
 }
 
 // Create a new tree with a stub root directory
 func NewTree(srv *Server) *File {
 	f := &File{
-		srv:      srv,
-		name:     "/",
-		isDir:    true,
-		Children: make([]*File, 0, maxChildren),
+		srv:   srv,
+		name:  "/",
+		isDir: true,
 	}
 
 	return f
@@ -61,85 +78,229 @@ func (t *File) LoadChildren() error {
 		return errors.New("is a file, not a dir")
 	}
 
-	// Bad, slow, hack
 	exists := func(n string) bool {
-		for _, child := range t.Children {
-			if n == child.name {
-				return true
-			}
-		}
-		return false
+		return t.children.get(n) != nil
+	}
+
+	t.srv.tree.RLock()
+	dir := t.Blob.dirURL
+	fresh := t.fresh()
+	t.srv.tree.RUnlock()
+
+	t.Blob.track()
+	if fresh {
+		return nil
 	}
 
 	ctx := context.Background()
-	files, dirs := Ls(ctx, t.Blob.dirURL)
+	files, dirs, err := List(ctx, dir)
+	if err != nil {
+		return err
+	}
 
-	for _, name := range files {
-		if exists(name) {
+	// Listing is done unlocked, the tree may have changed meanwhile
+	t.srv.tree.Lock()
+
+	var small []*Blob
+	seed := make(map[*Blob]int64)
+	for _, item := range files {
+		name := item.Name
+		size := itemSize(item)
+		if f := t.children.get(name); f != nil {
+			if !f.isDir {
+				seed[f.Blob] = size
+			}
+			if !f.isDir && size > 0 && size <= *prefetchSize {
+				small = append(small, f.Blob)
+			}
 			continue
 		}
+		// Contents are fetched on open, only metadata is needed here
 		f := t.NewChild(name, false)
-
-		err := f.Blob.Download(ctx)
-		if err != nil {
-			return errors.New("could not new child file → " + err.Error())
+		f.Blob.size = size
+		f.Blob.setRemote()
+		if size > 0 && size <= *prefetchSize {
+			small = append(small, f.Blob)
 		}
 	}
 
-	for _, name := range dirs {
+	for _, item := range dirs {
+		name := item.Name
 		if exists(name) {
 			continue
 		}
-		f := t.NewChild(name, true)
+		t.NewChild(name, true).Blob.setRemote()
+	}
+	t.listed = time.Now()
+	t.srv.tree.Unlock()
 
-		err := f.Blob.Download(ctx)
-		if err != nil {
-			return errors.New("could not new child dir → " + err.Error())
-		}
+	seedSizes(seed)
+	if len(small) > 0 {
+		go prefetchFiles(t.srv.ctx, small)
 	}
 
 	return nil
 }
 
+// Is our cached listing recent enough to skip relisting? The tree lock must be held
+func (t *File) fresh() bool {
+	return time.Since(t.listed) < *dirTTL
+}
+
+// Expire our cached listing so the next sync relists, the tree lock must be held
+func (t *File) invalidate() {
+	t.listed = time.Time{}
+}
+
 // Synchronize our tree with Azure remote
+// Tracked directories are walked depth-first, applying remote adds, removes, and type changes
+// Listings younger than the directory TTL are trusted rather than relisted
 func (t *File) Sync() error {
 	// TODO - sync up as well?
-	// TODO - nested directories handling?
 	// TODO - download only files that have changed
-	// DLFS TODO - walk the tree, if a directory is 'tracked'
 
+	t.srv.tree.RLock()
+	dir := t.Blob.dirURL
+	fresh := t.fresh()
+	t.srv.tree.RUnlock()
+
+	if fresh {
+		return t.syncTracked(nil)
+	}
+
+	// Nodes added or uploaded once the listing starts may be missing from it
+	started := time.Now()
 	ctx := context.Background()
-	files, dirs := Ls(ctx, t.Blob.dirURL)
-	isADir := func(n string) bool {
-		for _, name := range dirs {
-			if name == n {
-				return true
+	fileItems, dirItems, err := List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	t.reconcile(started, fileItems, dirItems)
+
+	return t.syncTracked(nil)
+}
+
+// Apply a listing of our directory begun at started, remote adds, removes, and type changes
+func (t *File) reconcile(started time.Time, fileItems []azfile.FileItem, dirItems []azfile.DirectoryItem) {
+	sizes := make(map[string]int64, len(fileItems))
+	files := make([]string, 0, len(fileItems))
+	dirs := make([]string, 0, len(dirItems))
+	for _, item := range fileItems {
+		files = append(files, item.Name)
+		sizes[item.Name] = itemSize(item)
+	}
+	for _, item := range dirItems {
+		dirs = append(dirs, item.Name)
+	}
+	isDirs := make(map[string]bool, len(dirs))
+	for _, name := range dirs {
+		isDirs[name] = true
+	}
+
+	t.srv.tree.Lock()
+
+	remotes := append(files, dirs...)
+	locals := make([]string, 0, t.children.len())
+
+	t.children.each(func(child *File) {
+		locals = append(locals, child.name)
+	})
+
+	// Deleted remotely, nodes we made which haven't reached the remote yet stay
+	// So do nodes with changes not yet uploaded, uploading them recreates the file
+	for _, name := range missingRemotely(locals, remotes) {
+		child := t.children.get(name)
+		if child.Blob.isRemote() && !child.Blob.isDirty() && child.predates(started) {
+			t.children.remove(name)
+		}
+	}
+
+	// Replaced remotely by the other type, a fresh node is added below
+	var changed []string
+	t.children.each(func(child *File) {
+		_, isFile := sizes[child.name]
+		if !child.predates(started) {
+			return
+		}
+		if (child.isDir && isFile) || (!child.isDir && !child.Blob.isDirty() && isDirs[child.name]) {
+			changed = append(changed, child.name)
+		}
+	})
+	for _, name := range changed {
+		t.children.remove(name)
+	}
+
+	// New remotely, in listing order, those we have take the listed size
+	seed := make(map[*Blob]int64)
+	for _, name := range remotes {
+		if child := t.children.get(name); child != nil {
+			if size, ok := sizes[name]; ok && !child.isDir && child.predates(started) {
+				seed[child.Blob] = size
 			}
+			continue
 		}
-		return false
+
+		f := t.NewChild(name, isDirs[name])
+		f.Blob.size = sizes[name]
+		f.Blob.setRemote()
 	}
 
-	remotes := append(files, dirs...)
-	locals := make([]string, len(t.Children))
+	t.listed = time.Now()
+	t.srv.tree.Unlock()
 
-	for i, _ := range t.Children {
-		locals[i] = t.Children[i].name
+	seedSizes(seed)
+}
+
+// Take file sizes from a listing, for blobs whose contents we don't hold
+// Blob locks are taken in turn, so no lock may be held
+func seedSizes(sizes map[*Blob]int64) {
+	for b, size := range sizes {
+		b.mu.Lock()
+		if !b.loaded && b.chunks == nil && !b.isDirty() {
+			b.size = size
+		}
+		b.mu.Unlock()
 	}
+}
 
-	diff := missingLocally(locals, remotes)
+// Could a listing begun at started speak for this node? The tree lock must be held
+// Nodes added, or found remotely, since it began are newer than anything it holds
+func (f *File) predates(started time.Time) bool {
+	return f.added.Before(started) && !f.Blob.remoteSince(started)
+}
 
-	for _, name := range diff {
-		// TODO - nested (and) dir handling
-		isDir := isADir(name)
+// Sync the tracked sub-directories of t, returning err or the first failure
+func (t *File) syncTracked(err error) error {
+	// Only directories someone has walked are worth descending into
+	var tracked []*File
+	t.srv.tree.RLock()
+	t.children.each(func(child *File) {
+		if child.isDir && child.Blob.isTracked() {
+			tracked = append(tracked, child)
+		}
+	})
+	t.srv.tree.RUnlock()
 
-		_ = t.NewChild(name, isDir)
+	for _, child := range tracked {
+		childErr := child.Sync()
+		if childErr != nil && err == nil {
+			err = childErr
+		}
 	}
 
-	return nil
+	return err
 }
 
 // Find a full path within the tree
 func (t *File) Search(full string) (*File, error) {
+	t.srv.tree.RLock()
+	defer t.srv.tree.RUnlock()
+
+	return t.search(full)
+}
+
+// Find a full path within the tree, the tree lock must be held
+func (t *File) search(full string) (*File, error) {
 	cleaned := path.Clean(full)
 	parts := strings.Split(cleaned, "/")
 
@@ -168,10 +329,8 @@ func recurseSearch(t *File, names []string) *File {
 		}
 	}
 
-	for _, child := range t.Children {
-		if child.name == names[0] {
-			return recurseSearch(child, names[1:])
-		}
+	if child := t.children.get(names[0]); child != nil {
+		return recurseSearch(child, names[1:])
 	}
 
 	return nil
@@ -179,6 +338,9 @@ func recurseSearch(t *File, names []string) *File {
 
 // Insert a new child somewhere in the tree ;; returns the Tree root
 func (t *File) Insert(full string, isDir bool) (*File, error) {
+	t.srv.tree.Lock()
+	defer t.srv.tree.Unlock()
+
 	var parent *File = t
 	var err error = nil
 	parentName, name := path.Split(full)
@@ -187,20 +349,19 @@ func (t *File) Insert(full string, isDir bool) (*File, error) {
 		goto Root
 	}
 
-	parent, err = t.Search(parentName)
+	parent, err = t.search(parentName)
 	if err != nil {
 		return t, errors.New(`could not find parent directory: "` + parentName + `" → ` + err.Error())
 	}
 
 Root:
 
-	for _, child := range parent.Children {
-		if child.name == name {
-			return t, errors.New(`file "` + full + `" exists`)
-		}
+	if parent.children.get(name) != nil {
+		return t, errors.New(`file "` + full + `" exists`)
 	}
 
 	f := parent.NewChild(name, isDir)
+	parent.invalidate()
 
 	// TODO - upload here?
 	//f.Blob.Upload(t.srv.ctx)
@@ -208,8 +369,95 @@ Root:
 	return f, nil
 }
 
+// Create a directory and any missing parents, locally and remotely
+// While Azure is unreachable the directories are journalled, as Tcreate does
+func (t *File) MkdirAll(full string) (*File, error) {
+	cleaned := path.Clean(full)
+	if cleaned == "/" {
+		return t, nil
+	}
+
+	// Hack over split, drops the / entry, assume we're /
+	parts := strings.Split(cleaned, "/")[1:]
+
+	dir := t
+	made := "/"
+	for _, name := range parts {
+		made = path.Join(made, name)
+
+		t.srv.tree.RLock()
+		next := dir.child(name)
+		dirURL := dir.Blob.dirURL
+		t.srv.tree.RUnlock()
+
+		if next != nil {
+			if !next.isDir {
+				return nil, errors.New(`"` + made + `" is a file, not a dir`)
+			}
+			dir = next
+			continue
+		}
+
+		// Someone else may have made it remotely since we last synced
+		var err error
+		held := journal.holding()
+		if !held {
+			_, err = dirURL.NewDirectoryURL(name).Create(t.srv.ctx, azfile.Metadata{}, azfile.SMBProperties{})
+			if err != nil && strings.Contains(err.Error(), string(azfile.ServiceCodeResourceAlreadyExists)) {
+				err = nil
+			}
+		}
+		journalled := held || journal.offline(err)
+		if journalled {
+			err = journal.record(journalEntry{Op: opCreate, Path: made, IsDir: true})
+		}
+		if err != nil {
+			return nil, errors.New(`could not create directory "` + made + `" → ` + err.Error())
+		}
+
+		// Or made it locally while we were creating it
+		t.srv.tree.Lock()
+		next = dir.child(name)
+		if next == nil {
+			next = dir.NewChild(name, true)
+			if !journalled {
+				next.Blob.setRemote()
+			}
+			dir.invalidate()
+		}
+		t.srv.tree.Unlock()
+
+		if !next.isDir {
+			return nil, errors.New(`"` + made + `" is a file, not a dir`)
+		}
+		if journalled {
+			next.Blob.Hold()
+		}
+		dir = next
+	}
+
+	return dir, nil
+}
+
+// Find an immediate child by name, the tree lock must be held
+func (t *File) child(name string) *File {
+	return t.children.get(name)
+}
+
+// Drop our children so they are relisted on the next walk
+func (t *File) forget() {
+	t.srv.tree.Lock()
+	defer t.srv.tree.Unlock()
+
+	t.children = childSet{}
+	t.invalidate()
+}
+
 // Delete a file from somewhere in the tree
 func (t *File) Delete(full string) error {
+	t.srv.tree.Lock()
+	defer t.srv.tree.Unlock()
+
 	var parent *File = t
 	var err error = nil
 	parentName, name := path.Split(full)
@@ -218,39 +466,234 @@ func (t *File) Delete(full string) error {
 		goto Root
 	}
 
-	parent, err = t.Search(parentName)
+	parent, err = t.search(parentName)
 	if err != nil {
 		return errors.New(`could not find parent directory: "` + parentName + `" - ` + err.Error())
 	}
 
-	// Find the child of the parent
+	// Find the child of the parent and cut it out
 Root:
-	for i, child := range parent.Children {
-		if child.name == name {
-			// Found the child, cut it from the child slice
-			left := parent.Children[:i]
-			if i < len(parent.Children)-1 {
-				right := parent.Children[i+1:]
-				parent.Children = append(left, right...)
-			} else {
-				parent.Children = left
+	if parent.children.remove(name) != nil {
+		parent.invalidate()
+		return nil
+	}
+
+	return errors.New(`could not find child "` + name + `"`)
+}
+
+// Rename or move a file or directory, remotely and then in the tree
+func (t *File) Rename(oldFull, newFull string) error {
+	oldFull = path.Clean(oldFull)
+	newFull = path.Clean(newFull)
+	if oldFull == "/" || newFull == "/" {
+		return errors.New("cannot rename the root")
+	}
+	if oldFull == newFull {
+		return nil
+	}
+
+	t.srv.tree.RLock()
+	f, parent, name, err := t.renameTarget(oldFull, newFull)
+	var dst azfile.DirectoryURL
+	if err == nil {
+		dst = parent.Blob.dirURL
+	}
+	t.srv.tree.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	held := journal.holding()
+	if !held {
+		err = f.Blob.Move(t.srv.ctx, dst, name)
+	}
+	if held || journal.offline(err) {
+		err = journal.record(journalEntry{Op: opRename, Path: oldFull, NewPath: newFull, IsDir: f.isDir})
+	} else if err != nil && f.isDir {
+		// Some contents may have moved and some not, relist both sides to match Azure
+		t.srv.tree.Lock()
+		f.parent.invalidate()
+		parent.invalidate()
+		t.srv.tree.Unlock()
+		f.forget()
+
+		return errors.New(`azure move failed partway, contents may be split between "` + oldFull + `" and "` + newFull + `" → ` + err.Error())
+	}
+	if err != nil {
+		return errors.New("azure move failed → " + err.Error())
+	}
+
+	// Remote is done, swap the node over in one go
+	t.srv.renames.Lock()
+	defer t.srv.renames.Unlock()
+
+	nodes := t.lockSubtree(f)
+	defer func() {
+		t.srv.tree.Unlock()
+		for _, n := range nodes {
+			n.Blob.mu.Unlock()
+		}
+	}()
+
+	// A sync may have found the new name remotely while we were moving
+	if stale := parent.child(name); stale != nil {
+		parent.detach(stale)
+	}
+
+	f.parent.detach(f)
+	f.parent.invalidate()
+	parent.invalidate()
+	f.name = name
+	f.parent = parent
+	parent.children.add(f)
+	f.rebase(dst)
+
+	return nil
+}
+
+// Lock the blobs of f and every node beneath it, then the tree, returning the nodes locked
+// Blob locks wait on transfers, so they are taken first rather than stalling everyone beneath the tree lock
+// Nodes may join the subtree while we wait, in which case we start over
+// Only renames hold several blob locks at once, so they must be serialised by srv.renames
+func (t *File) lockSubtree(f *File) []*File {
+	for {
+		t.srv.tree.RLock()
+		nodes := f.subtree(nil)
+		t.srv.tree.RUnlock()
+
+		locked := make(map[*File]bool, len(nodes))
+		for _, n := range nodes {
+			n.Blob.mu.Lock()
+			locked[n] = true
+		}
+
+		t.srv.tree.Lock()
+		complete := true
+		for _, n := range f.subtree(nil) {
+			if !locked[n] {
+				complete = false
+				break
 			}
+		}
+		if complete {
+			return nodes
+		}
 
-			return nil
+		t.srv.tree.Unlock()
+		for _, n := range nodes {
+			n.Blob.mu.Unlock()
 		}
 	}
+}
 
-	return errors.New(`could not find child "` + name + `"`)
+// Append f and every node beneath it to nodes, the tree lock must be held
+func (f *File) subtree(nodes []*File) []*File {
+	nodes = append(nodes, f)
+	f.children.each(func(child *File) {
+		nodes = child.subtree(nodes)
+	})
+
+	return nodes
 }
 
-// Create a new File as a child of t
+// Does a node have no children in the tree?
+func (f *File) empty() bool {
+	f.srv.tree.RLock()
+	defer f.srv.tree.RUnlock()
+
+	return f.children.len() == 0
+}
+
+// Give up on the unsent changes of a node and everything beneath it, once removed
+func (f *File) discard() {
+	f.srv.tree.RLock()
+	nodes := f.subtree(nil)
+	f.srv.tree.RUnlock()
+
+	for _, n := range nodes {
+		n.Blob.mu.Lock()
+		n.Blob.setClean()
+		n.Blob.mu.Unlock()
+	}
+}
+
+// Validate a rename, returning the node, its new parent, and new name
+// The tree lock must be held
+func (t *File) renameTarget(oldFull, newFull string) (f, parent *File, name string, err error) {
+	f, err = t.search(oldFull)
+	if err != nil {
+		return nil, nil, "", errors.New(`could not find "` + oldFull + `" → ` + err.Error())
+	}
+
+	parentName, name := path.Split(newFull)
+	parent, err = t.search(parentName)
+	if err != nil {
+		return nil, nil, "", errors.New(`could not find parent directory: "` + parentName + `" → ` + err.Error())
+	}
+	if !parent.isDir {
+		return nil, nil, "", errors.New(`"` + parentName + `" is a file, not a dir`)
+	}
+
+	// A directory can't be moved beneath itself
+	for p := parent; p != nil; p = p.parent {
+		if p == f {
+			return nil, nil, "", errors.New(`cannot move "` + oldFull + `" into itself`)
+		}
+	}
+
+	if parent.child(name) != nil {
+		return nil, nil, "", errors.New(`file "` + newFull + `" exists`)
+	}
+
+	return f, parent, name, nil
+}
+
+// Cut a child node out of our children, if present
+func (t *File) detach(child *File) {
+	if t.children.get(child.name) == child {
+		t.children.remove(child.name)
+	}
+}
+
+// Point a subtree's Azure URLs beneath a new parent directory
+// URLs are written under both the tree and blob locks, so either suffices to read them
+// The tree lock and the blob lock of every node in the subtree must be held
+func (f *File) rebase(dir azfile.DirectoryURL) {
+	f.Blob.parent = dir
+	f.Blob.statted = time.Time{}
+
+	// The copy at the new URL is a new version, which we hold unless we changed it since
+	f.Blob.setVersion(azfile.ETagNone, time.Time{})
+	f.Blob.base = azfile.ETagNone
+
+	if !f.isDir {
+		f.Blob.fileURL = dir.NewFileURL(f.name)
+		return
+	}
+
+	f.Blob.dirURL = dir.NewDirectoryURL(f.name)
+	f.children.each(func(child *File) {
+		child.rebase(f.Blob.dirURL)
+	})
+}
+
+// Returns the full path of the file, the tree lock must be held
+func (f *File) path() string {
+	if f.parent == nil {
+		return "/"
+	}
+
+	return path.Join(f.parent.path(), f.name)
+}
+
+// Create a new File as a child of t, the tree lock must be held
 func (t *File) NewChild(name string, isDir bool) *File {
 	child := &File{
-		parent:   t,
-		srv:      t.srv,
-		name:     name,
-		isDir:    isDir,
-		Children: make([]*File, 0, maxChildren),
+		parent: t,
+		srv:    t.srv,
+		name:   name,
+		isDir:  isDir,
+		added:  time.Now(),
 	}
 
 	// Hope this isn't nil :)
@@ -263,7 +706,7 @@ func (t *File) NewChild(name string, isDir bool) *File {
 		child.Blob.fileURL = t.Blob.dirURL.NewFileURL(name)
 	}
 
-	t.Children = append(t.Children, child)
+	t.children.add(child)
 
 	//t.reloadInfo()
 	return child
@@ -271,14 +714,17 @@ func (t *File) NewChild(name string, isDir bool) *File {
 
 // Total number of files in the tree
 func (t *File) Len() uint64 {
+	t.srv.tree.RLock()
+	defer t.srv.tree.RUnlock()
+
 	var descend func(t *File) uint64
 
 	descend = func(t *File) uint64 {
 		size := uint64(1)
 
-		for _, child := range t.Children {
+		t.children.each(func(child *File) {
 			size += descend(child)
-		}
+		})
 
 		return size
 	}
@@ -299,104 +745,207 @@ func (f *File) Open() error {
 // Close file
 func (f *File) Close() error {
 	// TODO - anything? maybe sync up to azure since we know we're done?
-	if f.IsDir() {
-		f.reloadInfo()
-	}
-	f.Blob.tracked = true
+	f.Blob.track()
+	f.Blob.closed()
 	log.Println("!!!! CLOSE")
-	return nil
+
+	// Writes held for the close are uploaded now, or by shutdown if it has begun
+	var err error
+	if !f.isDir && f.srv.enter() {
+		err = f.Blob.FlushMode(f.srv.ctx, writeOnClose)
+		f.srv.leave()
+	}
+
+	// The body may be idle now
+	bodies.reclaim()
+
+	return err
 }
 
 // Write from a certain offset - not called for directories
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
-	// Sync root
-	f.srv.File.Sync()
-	f.Blob.tracked = true
+	// Writes arriving once shutdown began would never be uploaded
+	if !f.srv.enter() {
+		return 0, errShutdown
+	}
+	defer f.srv.leave()
+	defer bodies.reclaim()
 
-	log.Println("!!!! ", f.name, " WRITEAT off=", off)
+	f.srv.tree.RLock()
+	full := f.path()
+	f.srv.tree.RUnlock()
+	mode := modeFor(full)
 
-	// TODO - Contents() maybe should have to sync - done above anyways for now
-	buf := f.Blob.Contents()
+	b := f.Blob
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.track()
 
-	// Might not be necessary or correct
-	if off > int64(len(buf)) {
-		return 0, io.EOF
-	}
+	log.Println("!!!! ", *b.name, " WRITEAT off=", off)
 
-	// Truncate file and write from offset
-	// TODO - should this casting be guarded?
-	if off < int64(len(buf)) {
-		// Truncating might not be the answer if this is intended
-		// to be insert rather than overwrite
-		f.Blob.body.Truncate(int(off))
+	// We upload the whole body, so we need the whole body, which must fit
+	if tooBig(off + int64(len(p))) {
+		return 0, errTooBig
 	}
-
-	n, err = f.Blob.body.Write(p)
+	err = b.load(f.srv.ctx)
 	if err != nil {
-		return n, err
+		return 0, err
+	}
+
+	if mode != writeThrough {
+		// Uploaded later, on close or by the flusher
+		b.writeAt(p, off)
+		b.setDirty(mode)
+		return len(p), nil
 	}
 
-	// Upload to blob storage
-	err = f.Blob.Upload(f.srv.ctx)
+	// Keep a copy of the contents so we can undo a failed upload
+	buf := append([]byte(nil), b.Contents()...)
+
+	// Overwrite in place, extending the file if we write past the end
+	b.writeAt(p, off)
+	n = len(p)
+
+	// Upload to blob storage, unless earlier changes wait in the journal to go first
+	held := journal.holding()
+	if !held {
+		err = b.upload(f.srv.ctx)
+	}
+	if held || journal.offline(err) {
+		// Kept here and replayed once Azure is back
+		err = journal.record(journalEntry{Op: opWrite, Path: full, Off: off, Data: append([]byte(nil), p...), Base: b.base})
+		if err == nil {
+			b.hold()
+		}
+	}
 	if err != nil {
-		// Undo changes if we fail
-		f.Blob.body.Reset()
-		f.Blob.body.Write(buf)
+		// Undo changes if we fail, a conflict has already dropped our body
+		b.setBody(buf)
 		return 0, err
 	}
 
 	return
 }
 
+// Fetch the contents of a file for reading, directories have none
+func (f *File) Fetch() error {
+	if f.isDir {
+		return nil
+	}
+	f.Blob.track()
+
+	return f.Blob.Prepare(f.srv.ctx)
+}
+
+// Send any changes to the file not yet uploaded to Azure, directories have none
+func (f *File) Flush() error {
+	if f.isDir {
+		return nil
+	}
+
+	return f.Blob.Flush(f.srv.ctx)
+}
+
+// Truncate or extend a file to size bytes
+func (f *File) Truncate(size int64) error {
+	if f.isDir {
+		return errors.New("is a dir, not a file")
+	}
+	f.Blob.track()
+
+	held := journal.holding()
+	var err error
+	if !held {
+		err = f.Blob.Truncate(f.srv.ctx, size)
+	}
+	if held || journal.offline(err) {
+		// Kept here and replayed once Azure is back
+		f.srv.tree.RLock()
+		full := f.path()
+		f.srv.tree.RUnlock()
+
+		var base azfile.ETag
+		base, err = f.Blob.truncateHeld(size)
+		if err == nil {
+			err = journal.record(journalEntry{Op: opTruncate, Path: full, Size: size, Base: base})
+		}
+	}
+
+	return err
+}
+
+// Set the last modified time of a file
+func (f *File) SetModTime(t time.Time) error {
+	if f.Blob == nil {
+		return errors.New("no remote for file")
+	}
+	f.Blob.track()
+
+	return f.Blob.SetModTime(f.srv.ctx, t)
+}
+
 // Read from a certain offset - not called for directories
 func (f *File) ReadAt(p []byte, offset int64) (n int, err error) {
-	// Sync root
-	f.srv.File.Sync()
-	f.Blob.tracked = true
+	defer bodies.reclaim()
+	b := f.Blob
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.track()
 
 	log.Println("!!!! READAT")
 
-	// TODO - don't download the whole file each time
-	f.Blob.Download(f.srv.ctx)
+	// Huge files are never held, reads go straight to Azure
+	if b.streamed() {
+		return b.readStream(f.srv.ctx, p, offset)
+	}
+
+	// Normally fetched on open, but be sure
+	if b.chunks != nil {
+		// Large files are read by chunk, only the chunks asked for are needed
+		err = b.fill(f.srv.ctx, offset, int64(len(p)))
+		if err == nil {
+			b.readahead(f.srv.ctx, offset, int64(len(p)))
+		}
+	} else {
+		err = b.load(f.srv.ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
 
 	if f.isDir {
 		// This will not be called
 		// See: Readdir()
 	}
 
-	if offset >= f.Size() {
+	buf := b.Contents()
+	if offset >= int64(len(buf)) {
 		return 0, io.EOF
 	}
 
-	buf := f.Blob.Contents()
 	n = copy(p, buf[offset:])
 
 	return n, nil
 }
 
 // Is this file a directory?
-func (f File) IsDir() bool {
-	// Sync root
-	f.srv.File.Sync()
-
+func (f *File) IsDir() bool {
 	//log.Println("!!¡¡ is ", f.name, " a dir? ", f.isDir)
 
 	return f.isDir
 }
 
 // Returns the singleton name of the file `/foo/bar` is `bar`
-func (f File) Name() string {
-	// Sync root
-	f.srv.File.Sync()
+func (f *File) Name() string {
+	f.srv.tree.RLock()
+	defer f.srv.tree.RUnlock()
 
 	return f.name
 }
 
 // Returns the size of the file contents
-func (f File) Size() int64 {
-	// Sync root
-	f.srv.File.Sync()
-	f.Blob.tracked = true
+func (f *File) Size() int64 {
+	f.Blob.track()
 
 	log.Println("!!!! SIZE")
 
@@ -404,116 +953,237 @@ func (f File) Size() int64 {
 		// Size is number of children
 		// Seems to work
 		// Previously: 0
-		return int64(len(f.Children))
+		f.srv.tree.RLock()
+		defer f.srv.tree.RUnlock()
+		return int64(f.children.len())
 	}
 
-	// TODO maybe acquire from here
-	f.Blob.Stat()
+	// Kept current by listings, stats, and local writes
+	f.Blob.mu.Lock()
+	defer f.Blob.mu.Unlock()
 
-	// TODO - get this info from azure, not the buffer, for lazy loading
-	return int64(len(f.Blob.Contents()))
+	if !f.Blob.loaded {
+		f.stat()
+	}
+	return f.Blob.size
 }
 
 // Returns the permission bits (uint32)
 // FileMode examples and how they propagate: https://play.golang.org/p/jb2Z3iA2DqE
-func (f File) Mode() os.FileMode {
-	// Sync root
-	f.srv.File.Sync()
+func (f *File) Mode() os.FileMode {
+	mode := modeOf(f.IsDir())
+
+	f.srv.tree.RLock()
+	log.Println("«« Mode for", f.name, "=", uint32(mode))
+	f.srv.tree.RUnlock()
+
+	return mode
+}
 
+// Permission bits for a file or directory
+func modeOf(isDir bool) os.FileMode {
 	mode := uint32(0777)
 
 	// TODO - derive from azure storage and XOR sane defaults?
-	if f.IsDir() {
+	if isDir {
 		// We are a directory
 		mode = uint32(uint32(os.ModeDir) | uint32(0777))
 	}
 
-	log.Println("«« Mode for", f.name, "=", mode)
-
 	// We are a regular file
 	return os.FileMode(mode)
 }
 
 // Returns the time of the last modification of the file
-func (f File) ModTime() time.Time {
-	// Sync root
-	f.srv.File.Sync()
+func (f *File) ModTime() time.Time {
+	if f.Blob == nil {
+		return time.Now()
+	}
+
+	f.Blob.mu.Lock()
+	defer f.Blob.mu.Unlock()
+
+	f.stat()
+	if !f.Blob.mtime.IsZero() {
+		return f.Blob.mtime
+	}
 
-	// TODO - ask blob storage?
 	return time.Now()
 }
 
 // Returns "the underlying data source"
-func (f File) Sys() interface{} {
-	// Sync root
-	f.srv.File.Sync()
+func (f *File) Sys() interface{} {
+	if f.Blob == nil {
+		return nil
+	}
 
-	// TODO?
-	return nil
+	f.Blob.mu.Lock()
+	defer f.Blob.mu.Unlock()
+
+	f.stat()
+	return f.Blob.sysInfo()
 }
 
-// Returns the info that styx wants
-func (f File) Stat() os.FileInfo {
-	// Sync root
-	f.srv.File.Sync()
+// Azure-specific information as cached, the blob lock must be held
+func (b *Blob) sysInfo() *SysInfo {
+	return &SysInfo{
+		Ctime:        b.ctime,
+		ETag:         string(b.etag),
+		LastModified: b.lastMod,
+		Version:      b.version(),
+	}
+}
 
-	return f
+// Qid version of the file, changes when the remote contents do
+// Upstream styx builds every qid with version 0, only a qid pool which asks us uses it
+func (f *File) Version() uint32 {
+	if f.Blob == nil {
+		return 0
+	}
+
+	f.Blob.mu.Lock()
+	defer f.Blob.mu.Unlock()
+
+	f.stat()
+	return f.Blob.version()
 }
 
-// Reload the channel for Readdir()
-func (f *File) reloadInfo() {
-	log.Println("« Reloading info for file: ", f.Name())
-	f.info = make(chan os.FileInfo, infoBuf)
-	go func() {
-		for i := 0; i < len(f.Children); i++ {
-			f.info <- f.Children[i]
-		}
-		close(f.info)
-	}()
+// Stat the remote if our cached properties have expired, failure leaves them as-is
+// The blob lock must be held
+func (f *File) stat() {
+	if f.Blob.fresh() {
+		return
+	}
+
+	err := f.Blob.stat(f.srv.ctx)
+	if err != nil {
+		log.Println("stat of", *f.Blob.name, "failed →", err)
+	}
+}
+
+// Returns the info that styx wants
+func (f *File) Stat() os.FileInfo {
+	return f.VF()
 }
 
 // Styx says we must implement Readdir() or marshal directory information ourselves through ReadAt()
 // See: https://pkg.go.dev/aqwari.net/net/styx?tab=doc#Directory
-func (f *File) Readdir(n int) ([]os.FileInfo, error) {
-	// Sync root
-	f.srv.File.Sync()
+// Each open handle reads through its own cursor, so listings don't interleave
+// Reopening starts over, seeking back to offset 0 does not: styx's dirReader refuses any offset but its own
+func (f *File) readdir(c *dirCursor, n int) ([]os.FileInfo, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Start a pass from a snapshot of our children, relisting if the cache expired
+	if c.entries == nil {
+		err := f.Sync()
+		if err != nil {
+			log.Println("sync of", f.Name(), "failed →", err)
+		}
 
-	// Nothing to list
-	if len(f.Children) == 0 {
-		return nil, io.EOF
+		c.entries = f.entries()
+		c.pos = 0
 	}
 
-	// If channel is nil, push into channel
-	// We will close when done
+	// Finished, styx asks again on any later read, which stays at the end until the handle is reopened
+	if c.pos >= len(c.entries) {
+		return nil, io.EOF
+	}
 
-	if f.info == nil {
-		f.reloadInfo()
+	end := len(c.entries)
+	if n > 0 && c.pos+n < end {
+		end = c.pos + n
 	}
 
-	var err error
-	fi := make([]os.FileInfo, 0, infoBuf)
-	for i := 0; i < n; i++ {
-		s, ok := <-f.info
-		if !ok {
-			err = io.EOF
-			break
+	fi := c.entries[c.pos:end]
+	c.pos = end
+
+	return fi, nil
+}
+
+// Snapshot our children as directory entries, from cached attributes
+// styx asks each entry for its size and time, which would otherwise stat every file in turn
+func (f *File) entries() []os.FileInfo {
+	f.srv.tree.RLock()
+	children := make([]*File, 0, f.children.len())
+	entries := make([]dirEntry, 0, f.children.len())
+	f.children.each(func(child *File) {
+		e := dirEntry{
+			name: child.name,
+			mode: modeOf(child.isDir),
+		}
+		if child.isDir {
+			// Size is number of children, as for Size()
+			e.size = int64(child.children.len())
 		}
-		fi = append(fi, s)
+		children = append(children, child)
+		entries = append(entries, e)
+	})
+	f.srv.tree.RUnlock()
+
+	// Blob locks are taken beneath no tree lock, one at a time
+	fi := make([]os.FileInfo, len(entries))
+	for i, child := range children {
+		e := &entries[i]
+
+		b := child.Blob
+		b.mu.Lock()
+		if !child.isDir {
+			e.size = b.size
+		}
+		e.mtime = b.mtime
+		e.sys = b.sysInfo()
+		b.mu.Unlock()
+
+		if e.mtime.IsZero() {
+			// Not yet statted, as for ModTime()
+			e.mtime = time.Now()
+		}
+		fi[i] = *e
 	}
-	return fi, err
+
+	return fi
+}
+
+// A directory entry as snapshotted for a listing - See: entries()
+type dirEntry struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	sys   *SysInfo
+}
+
+func (e dirEntry) Name() string       { return e.name }
+func (e dirEntry) Size() int64        { return e.size }
+func (e dirEntry) Mode() os.FileMode  { return e.mode }
+func (e dirEntry) ModTime() time.Time { return e.mtime }
+func (e dirEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e dirEntry) Sys() interface{}   { return e.sys }
+func (e dirEntry) Uid() string        { return uid }
+func (e dirEntry) Gid() string        { return gid }
+func (e dirEntry) Muid() string       { return muid }
+
+// Drop a cursor's snapshot, the next read starts from the first entry
+func (c *dirCursor) rewind() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.entries = nil
+	c.pos = 0
 }
 
 // User ID of a file
-func (f File) Uid() string {
+func (f *File) Uid() string {
 	return uid
 }
 
 // Group ID of a file
-func (f File) Gid() string {
+func (f *File) Gid() string {
 	return gid
 }
 
 // Modified User ID of a file
-func (f File) Muid() string {
+func (f *File) Muid() string {
 	return muid
 }
@@ -0,0 +1,504 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+func TestMain(m *testing.M) {
+	// Every operation logs, which drowns out test output
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// A share root whose requests all fail without reaching the network
+func offlineRoot() azfile.DirectoryURL {
+	u, _ := url.Parse("https://account.file.core.windows.net/share")
+	fail := pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			return nil, errors.New("offline")
+		}
+	})
+
+	return azfile.NewDirectoryURL(*u, pipeline.NewPipeline(nil, pipeline.Options{HTTPSender: fail}))
+}
+
+// A server with an empty tree beneath an offline share root
+func newTestServer() *Server {
+	srv := &Server{ctx: context.Background()}
+	srv.Initialize()
+	srv.Blob = NewBlob(&srv.File.name, offlineRoot(), true)
+	srv.Blob.dirURL = offlineRoot()
+
+	return srv
+}
+
+// Hold changes in a journal, as while Azure is unreachable, so renames never go remote
+func holdJournal(t testing.TB) {
+	var err error
+	journal, err = OpenJournal(filepath.Join(t.TempDir(), "journal"), offlineRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.record(journalEntry{Op: opCreate, Path: "/held", IsDir: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check every child points back at its parent and is indexed where it sits
+func checkTree(t *testing.T, f *File) {
+	f.srv.tree.RLock()
+	defer f.srv.tree.RUnlock()
+
+	var walk func(dir *File)
+	walk = func(dir *File) {
+		n := 0
+		for i, child := range dir.children.order {
+			if child == nil {
+				continue
+			}
+			n++
+			if child.parent != dir {
+				t.Errorf("%q has the wrong parent", child.name)
+			}
+			if dir.children.index[child.name] != i {
+				t.Errorf("%q is indexed at %d, sits at %d", child.name, dir.children.index[child.name], i)
+			}
+			walk(child)
+		}
+		if n != dir.children.len() {
+			t.Errorf("%q holds %d children, indexes %d", dir.name, n, dir.children.len())
+		}
+	}
+	walk(f)
+}
+
+// Many sessions changing and reading the tree at once, run under -race
+func TestTreeStress(t *testing.T) {
+	srv := newTestServer()
+	holdJournal(t)
+	defer func() { journal = nil }()
+
+	const (
+		dirs    = 4
+		files   = 32
+		workers = 16
+		ops     = 300
+	)
+
+	for d := 0; d < dirs; d++ {
+		_, err := srv.File.Insert(fmt.Sprintf("/d%d", d), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			file := func() string {
+				return fmt.Sprintf("/d%d/f%d", rng.Intn(dirs), rng.Intn(files))
+			}
+
+			for i := 0; i < ops; i++ {
+				switch rng.Intn(6) {
+				case 0:
+					srv.File.Insert(file(), rng.Intn(4) == 0)
+				case 1:
+					srv.File.Delete(file())
+				case 2:
+					srv.File.Rename(file(), file())
+				case 3:
+					f, err := srv.File.Search(file())
+					if err == nil {
+						f.Name()
+					}
+				case 4:
+					f, err := srv.File.Search(fmt.Sprintf("/d%d", rng.Intn(dirs)))
+					if err != nil {
+						continue
+					}
+					vf := f.VF()
+					for {
+						fi, err := vf.Readdir(rng.Intn(4))
+						for _, e := range fi {
+							e.Name()
+						}
+						if err != nil {
+							break
+						}
+					}
+				case 5:
+					srv.File.Len()
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	checkTree(t, srv.File)
+}
+
+// Renames swap whole subtrees, URLs and all
+func TestRenameSubtree(t *testing.T) {
+	srv := newTestServer()
+	holdJournal(t)
+	defer func() { journal = nil }()
+
+	for _, p := range []string{"/a", "/a/b", "/c"} {
+		_, err := srv.File.Insert(p, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := srv.File.Insert("/a/b/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = srv.File.Rename("/a", "/c/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.File.Search("/a"); err == nil {
+		t.Error("/a still present after rename")
+	}
+	f, err := srv.File.Search("/c/a/b/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := path.Join(offlineRoot().URL().Path, "c/a/b/f")
+	if got := f.Blob.fileURL.URL().Path; got != want {
+		t.Errorf("renamed file URL is %q, want %q", got, want)
+	}
+
+	if err := srv.File.Rename("/c", "/c/a/c"); err == nil {
+		t.Error("moved a directory beneath itself")
+	}
+	if err := srv.File.Rename("/", "/x"); err == nil {
+		t.Error("renamed the root")
+	}
+
+	checkTree(t, srv.File)
+}
+
+// A directory read returns every child in order, then stays at the end
+func TestReaddir(t *testing.T) {
+	srv := newTestServer()
+	for i := 0; i < 10; i++ {
+		_, err := srv.File.Insert(fmt.Sprintf("/f%d", i), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vf := srv.File.VF()
+	var names []string
+	for {
+		fi, err := vf.Readdir(3)
+		for _, e := range fi {
+			names = append(names, e.Name())
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(names) != 10 {
+		t.Fatalf("read %d entries, want 10: %v", len(names), names)
+	}
+	for i, name := range names {
+		if name != fmt.Sprintf("f%d", i) {
+			t.Errorf("entry %d is %q", i, name)
+		}
+	}
+
+	// styx reads again at the end offset, which must not serve the listing twice
+	fi, err := vf.Readdir(3)
+	if len(fi) != 0 || err != io.EOF {
+		t.Errorf("read past the end gave %d entries, %v", len(fi), err)
+	}
+}
+
+// A tree holding a directory of a million files, its listing fresh so reads stay local
+var (
+	bigOnce sync.Once
+	bigSrv  *Server
+)
+
+const bigFiles = 1000000
+
+func bigTree(b *testing.B) *Server {
+	bigOnce.Do(func() {
+		*dirTTL = time.Hour
+		bigSrv = newTestServer()
+
+		dir, err := bigSrv.File.Insert("/big", true)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		bigSrv.tree.Lock()
+		for i := 0; i < bigFiles; i++ {
+			dir.NewChild(fmt.Sprintf("f%d", i), false)
+		}
+		bigSrv.File.listed = time.Now()
+		dir.listed = time.Now()
+		bigSrv.tree.Unlock()
+	})
+
+	return bigSrv
+}
+
+// Walk to files in a directory of a million
+func BenchmarkWalk(b *testing.B) {
+	srv := bigTree(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := lookup(srv, fmt.Sprintf("/big/f%d", i%bigFiles))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// List a directory of a million files, as a client reading it through
+func BenchmarkList(b *testing.B) {
+	srv := bigTree(b)
+	dir, err := srv.File.Search("/big")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vf := dir.VF()
+		n := 0
+		for {
+			fi, err := vf.Readdir(64)
+			n += len(fi)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if n != bigFiles {
+			b.Fatalf("listed %d, want %d", n, bigFiles)
+		}
+	}
+}
+
+// A listing can't remove nodes added or uploaded after it began
+func TestReconcileStale(t *testing.T) {
+	srv := newTestServer()
+
+	for _, name := range []string{"/old", "/gone", "/uploaded"} {
+		_, err := srv.File.Insert(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Begun before /made joined the tree and /uploaded reached Azure, which it misses
+	started := time.Now()
+	before := started.Add(-time.Second)
+	srv.tree.Lock()
+	for _, name := range []string{"old", "gone", "uploaded"} {
+		f := srv.File.children.get(name)
+		f.added = before
+		atomic.StoreInt64(&f.Blob.remoteAt, before.UnixNano())
+	}
+	srv.File.children.get("uploaded").Blob.setRemote()
+	srv.tree.Unlock()
+
+	// Listed as a directory by the stale listing
+	_, err := srv.File.Insert("/made", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.File.reconcile(started, []azfile.FileItem{{Name: "old"}, {Name: "new"}}, []azfile.DirectoryItem{{Name: "dir"}, {Name: "made"}})
+
+	for _, name := range []string{"/old", "/made", "/uploaded", "/new", "/dir"} {
+		if _, err := srv.File.Search(name); err != nil {
+			t.Errorf("%s missing after sync", name)
+		}
+	}
+	if _, err := srv.File.Search("/gone"); err == nil {
+		t.Error("/gone survived sync")
+	}
+	if f, _ := srv.File.Search("/dir"); f == nil || !f.isDir {
+		t.Error("/dir not added as a directory")
+	}
+	if f, _ := srv.File.Search("/made"); f == nil || f.isDir {
+		t.Error("/made replaced by the stale listing")
+	}
+}
+
+// Listings seed sizes, and directory reads answer from them without a stat per entry
+func TestListingSizes(t *testing.T) {
+	srv := newTestServer()
+
+	f, err := srv.File.Insert("/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.tree.Lock()
+	f.added = time.Now().Add(-time.Second)
+	srv.tree.Unlock()
+
+	srv.File.reconcile(time.Now(), []azfile.FileItem{{Name: "f", Properties: &azfile.FileProperty{ContentLength: 42}}}, nil)
+
+	fi, err := srv.File.VF().Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 1 || fi[0].Name() != "f" || fi[0].Size() != 42 {
+		t.Fatalf("listed %v, want f of 42 bytes", fi)
+	}
+
+	f.Blob.mu.Lock()
+	defer f.Blob.mu.Unlock()
+	if !f.Blob.statted.IsZero() {
+		t.Error("listing statted the file")
+	}
+}
+
+// Files too big to hold are refused rather than loaded
+func TestWriteTooBig(t *testing.T) {
+	old := *streamSize
+	*streamSize = 1024
+	defer func() { *streamSize = old }()
+
+	srv := newTestServer()
+	f, err := srv.File.Insert("/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("x"), 1024); err != errTooBig {
+		t.Errorf("write past -streamsize gave %v", err)
+	}
+	if err := f.Blob.Truncate(srv.ctx, 2048); err != errTooBig {
+		t.Errorf("truncate past -streamsize gave %v", err)
+	}
+
+	// Already over, as a fresh stat says
+	f.Blob.mu.Lock()
+	f.Blob.size = 4096
+	f.Blob.statted = time.Now()
+	f.Blob.mu.Unlock()
+
+	if _, err := f.WriteAt([]byte("x"), 0); err != errTooBig {
+		t.Errorf("write to a file over -streamsize gave %v", err)
+	}
+	if err := f.Blob.Truncate(srv.ctx, 1); err != errTooBig {
+		t.Errorf("truncate of a file over -streamsize gave %v", err)
+	}
+}
+
+// Deep directories are made with their missing parents, journalled while changes are held
+func TestMkdirAll(t *testing.T) {
+	srv := newTestServer()
+	holdJournal(t)
+	defer func() { journal = nil }()
+
+	c, err := srv.File.MkdirAll("/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/a/b", "/a/b/c"} {
+		f, err := srv.File.Search(p)
+		if err != nil || !f.isDir {
+			t.Errorf("%s not made as a directory", p)
+		}
+	}
+
+	again, err := srv.File.MkdirAll("/a/b/c/")
+	if err != nil || again != c {
+		t.Errorf("second make gave %v, %v", again, err)
+	}
+	if root, err := srv.File.MkdirAll("/"); err != nil || root != srv.File {
+		t.Errorf("make of the root gave %v, %v", root, err)
+	}
+
+	_, err = srv.File.Insert("/a/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.File.MkdirAll("/a/f/g"); err == nil {
+		t.Error("made a directory beneath a file")
+	}
+
+	// One create each, after the entry holdJournal left
+	var made []string
+	for _, e := range journal.entries[1:] {
+		if e.Op == opCreate && e.IsDir {
+			made = append(made, e.Path)
+		}
+	}
+	if fmt.Sprint(made) != "[/a /a/b /a/b/c]" {
+		t.Errorf("journalled %v", made)
+	}
+}
+
+// Qid versions follow the ETag, zero while it is unknown
+func TestVersion(t *testing.T) {
+	srv := newTestServer()
+	f, err := srv.File.Insert("/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := f.Blob
+	b.mu.Lock()
+	b.statted = time.Now()
+	none := b.version()
+	b.setVersion(`"v1"`, time.Now())
+	v1 := b.version()
+	b.setVersion(`"v2"`, time.Now())
+	v2 := b.version()
+	b.mu.Unlock()
+
+	if none != 0 {
+		t.Errorf("unknown version is %d, want 0", none)
+	}
+	if v1 == 0 || v1 == v2 {
+		t.Errorf("versions %d and %d don't tell ETags apart", v1, v2)
+	}
+	if got := f.VF().Version(); got != v2 {
+		t.Errorf("handle reports version %d, want %d", got, v2)
+	}
+	if got := f.Sys().(*SysInfo).Version; got != v2 {
+		t.Errorf("stat reports version %d, want %d", got, v2)
+	}
+}
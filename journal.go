@@ -0,0 +1,567 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Journal of changes made while Azure is unreachable, replayed once it is back
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+const (
+	probeTimeout = 10 * time.Second // How long a reachability probe may take
+	replayPoll   = 15 * time.Second // Interval to check whether a waiting journal can be replayed
+)
+
+// Kinds of journalled change
+const (
+	opCreate   = "create"
+	opWrite    = "write"
+	opTruncate = "truncate"
+	opRemove   = "remove"
+	opRename   = "rename"
+)
+
+// One change, as a line of JSON in the journal file
+type journalEntry struct {
+	Op      string      `json:"op"`
+	Path    string      `json:"path"`
+	NewPath string      `json:"newpath,omitempty"` // Rename target
+	IsDir   bool        `json:"dir,omitempty"`
+	All     bool        `json:"all,omitempty"`  // Remove a directory and its contents
+	Off     int64       `json:"off,omitempty"`  // Write offset
+	Data    []byte      `json:"data,omitempty"` // Written bytes
+	Size    int64       `json:"size,omitempty"` // Truncate size
+	Base    azfile.ETag `json:"base,omitempty"` // Version the change was made against, if known
+}
+
+// Changes waiting for Azure, kept on disk so they survive restarts
+// Lock order is blob then journal, replay takes no other locks while holding ours
+type Journal struct {
+	path      string              // Journal file
+	root      azfile.DirectoryURL // Share root, paths are replayed beneath it
+	mu        sync.Mutex          // Guards everything below
+	file      *os.File            // Journal file, open for appending
+	entries   []journalEntry      // Changes not yet replayed, oldest first
+	conflicts []string            // Changes replay refused, for reporting
+}
+
+// The journal in use, nil if disabled
+var journal *Journal
+
+// Open a journal file, picking up any changes a previous run couldn't replay
+func OpenJournal(name string, root azfile.DirectoryURL) (*Journal, error) {
+	j := &Journal{
+		path: name,
+		root: root,
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("could not read journal → " + err.Error())
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 2*maxRange+4096)
+	for scanner.Scan() {
+		var e journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// Only a crash mid-append leaves a bad line, and only the last
+			log.Println("dropping torn journal entry →", err)
+			break
+		}
+		j.entries = append(j.entries, e)
+	}
+
+	// Rewriting drops any torn tail before we append after it
+	err = j.rewrite()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Journal holds %d changes to replay\n", len(j.entries))
+	return j, nil
+}
+
+// Are changes waiting for replay? Later changes must queue behind them
+// Safe on a nil journal
+func (j *Journal) holding() bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.entries) > 0
+}
+
+// Did a change fail because Azure is unreachable, rather than refused?
+// Safe on a nil journal, which never takes changes
+func (j *Journal) offline(err error) bool {
+	return j != nil && err != nil && j.unreachable()
+}
+
+// Probe the share, failing without a storage error means we can't reach it
+func (j *Journal) unreachable() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	_, err := j.root.GetProperties(ctx)
+	if err == nil {
+		return false
+	}
+
+	_, refused := err.(azfile.StorageError)
+	return !refused
+}
+
+// Append a change, durably, before it is acknowledged
+func (j *Journal) record(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return errors.New("journal write failed → " + err.Error())
+	}
+
+	log.Println("!!!! JOURNALLED", e.Op, e.Path)
+	j.entries = append(j.entries, e)
+
+	return nil
+}
+
+// Replace the journal file with the entries still waiting, the journal lock must be held
+func (j *Journal) rewrite() error {
+	var buf bytes.Buffer
+	for _, e := range j.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// Written aside and renamed, so a crash leaves either the old journal or the new
+	tmp := j.path + tmpSuffix
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		return errors.New("journal rewrite failed → " + err.Error())
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.New("journal open failed → " + err.Error())
+	}
+
+	return nil
+}
+
+// Changes waiting and conflicts met so far, for reporting
+func (j *Journal) Stats() (waiting int, conflicts []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.entries), append([]string(nil), j.conflicts...)
+}
+
+// Replay waiting changes whenever Azure is reachable, forever
+func (j *Journal) run(srv *Server) {
+	for range time.Tick(replayPoll) {
+		if !j.holding() || j.unreachable() {
+			continue
+		}
+
+		j.replay(srv)
+	}
+}
+
+// Apply waiting changes to Azure in order, stopping if it becomes unreachable again
+// Changes Azure refuses are dropped, and conflicting ones reported
+func (j *Journal) replay(srv *Server) {
+	j.mu.Lock()
+
+	r := &replayer{
+		ctx:      srv.ctx,
+		root:     j.root,
+		expect:   make(map[string]azfile.ETag),
+		skip:     make(map[string]bool),
+		versions: make(map[string]replayedVersion),
+		written:  make(map[string]bool),
+	}
+
+	n := 0
+	for ; n < len(j.entries); n++ {
+		e := j.entries[n]
+		err := r.apply(e)
+		if err == nil {
+			continue
+		}
+
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			log.Println("journal conflict →", err)
+			j.conflicts = append(j.conflicts, err.Error())
+			continue
+		}
+		if j.unreachable() {
+			break
+		}
+		log.Println("journal replay of", e.Op, e.Path, "refused →", err)
+	}
+	r.finish()
+
+	log.Printf("Replayed %d journalled changes, %d waiting\n", n, len(j.entries)-n)
+	j.entries = append([]journalEntry(nil), j.entries[n:]...)
+	err := j.rewrite()
+	if err != nil {
+		log.Println(err)
+	}
+
+	j.mu.Unlock()
+
+	// Our nodes hold the replayed contents, so now hold the versions replay made
+	// Done without the journal lock, as blob locks are taken before it
+	for full, v := range r.versions {
+		if r.skip[full] {
+			// Ours and theirs differ, the next upload reports it
+			continue
+		}
+
+		f, err := srv.File.Search(full)
+		if err != nil || f.Blob == nil {
+			continue
+		}
+
+		f.Blob.mu.Lock()
+		f.Blob.setVersion(v.etag, v.lastMod)
+		f.Blob.base = v.etag
+		f.Blob.pending = false
+		f.Blob.statted = time.Time{}
+		f.Blob.setRemote()
+		f.Blob.mu.Unlock()
+	}
+
+	// With nothing left to replay, no body is the only copy of anything
+	if !j.holding() {
+		srv.tree.RLock()
+		nodes := srv.File.subtree(nil)
+		srv.tree.RUnlock()
+
+		for _, n := range nodes {
+			n.Blob.mu.Lock()
+			n.Blob.pending = false
+			n.Blob.mu.Unlock()
+		}
+	}
+}
+
+// The version of a path once replay is done with it
+type replayedVersion struct {
+	etag    azfile.ETag
+	lastMod time.Time
+}
+
+// State of one replay pass
+type replayer struct {
+	ctx      context.Context
+	root     azfile.DirectoryURL
+	expect   map[string]azfile.ETag     // Version each path should be at, from our last change to it
+	skip     map[string]bool            // Paths which conflicted, later changes to them are dropped
+	versions map[string]replayedVersion // Version each path was left at
+	written  map[string]bool            // Files whose contents changed, so whose MD5 is stale
+}
+
+// Directory URL for a path beneath the share root
+func (r *replayer) dir(full string) azfile.DirectoryURL {
+	url := r.root
+	for _, name := range strings.Split(strings.Trim(full, "/"), "/") {
+		if name != "" {
+			url = url.NewDirectoryURL(name)
+		}
+	}
+
+	return url
+}
+
+// File URL for a path beneath the share root
+func (r *replayer) file(full string) azfile.FileURL {
+	parent, name := path.Split(full)
+	return r.dir(parent).NewFileURL(name)
+}
+
+// Note the version a change left a path at
+func (r *replayer) made(full string, etag azfile.ETag, lastMod time.Time) {
+	r.expect[full] = etag
+	r.versions[full] = replayedVersion{etag, lastMod}
+}
+
+// Check a file is still at the version e was made against, or we last left it at
+// Returns its properties, nil if it doesn't exist
+func (r *replayer) check(e journalEntry, url azfile.FileURL) (*azfile.FileGetPropertiesResponse, error) {
+	want, ok := r.expect[e.Path]
+	if !ok {
+		want = e.Base
+	}
+
+	props, err := url.GetProperties(r.ctx)
+	got := azfile.ETagNone
+	if err == nil {
+		got = props.ETag()
+	} else if !notFound(err) {
+		return nil, err
+	} else {
+		props = nil
+	}
+
+	if want != azfile.ETagNone && got != want {
+		r.skip[e.Path] = true
+		return nil, &ConflictError{Name: e.Path, Want: want, Got: got}
+	}
+
+	return props, nil
+}
+
+// Apply one change to Azure
+func (r *replayer) apply(e journalEntry) error {
+	if r.skip[e.Path] {
+		return nil
+	}
+
+	switch e.Op {
+	case opCreate:
+		if e.IsDir {
+			_, err := r.dir(e.Path).Create(r.ctx, azfile.Metadata{}, azfile.SMBProperties{})
+			if err != nil && !strings.Contains(err.Error(), string(azfile.ServiceCodeResourceAlreadyExists)) {
+				return err
+			}
+			return nil
+		}
+
+		url := r.file(e.Path)
+		props, err := r.check(e, url)
+		if err != nil {
+			return err
+		}
+		if props != nil {
+			// Made elsewhere while we were away
+			r.skip[e.Path] = true
+			return &ConflictError{Name: e.Path, Got: props.ETag()}
+		}
+
+		created, err := url.Create(r.ctx, 0, azfile.FileHTTPHeaders{ContentType: "text/plain"}, azfile.Metadata{})
+		if err != nil {
+			return err
+		}
+		r.made(e.Path, created.ETag(), created.LastModified())
+
+	case opWrite:
+		url := r.file(e.Path)
+		props, err := r.check(e, url)
+		if err != nil {
+			return err
+		}
+		if props == nil {
+			r.skip[e.Path] = true
+			return &ConflictError{Name: e.Path, Want: e.Base}
+		}
+
+		end := e.Off + int64(len(e.Data))
+		if end > props.ContentLength() {
+			_, err = url.Resize(r.ctx, end)
+			if err != nil {
+				return err
+			}
+		}
+
+		for off := int64(0); off < int64(len(e.Data)); off += maxRange {
+			stop := off + maxRange
+			if stop > int64(len(e.Data)) {
+				stop = int64(len(e.Data))
+			}
+
+			part := e.Data[off:stop]
+			sum := md5.Sum(part)
+			uploaded, err := url.UploadRange(r.ctx, e.Off+off, bytes.NewReader(part), sum[:])
+			if err != nil {
+				return err
+			}
+			r.made(e.Path, uploaded.ETag(), uploaded.LastModified())
+		}
+		r.written[e.Path] = true
+
+	case opTruncate:
+		url := r.file(e.Path)
+		props, err := r.check(e, url)
+		if err != nil {
+			return err
+		}
+		if props == nil {
+			r.skip[e.Path] = true
+			return &ConflictError{Name: e.Path, Want: e.Base}
+		}
+
+		resized, err := url.Resize(r.ctx, e.Size)
+		if err != nil {
+			return err
+		}
+		r.made(e.Path, resized.ETag(), resized.LastModified())
+		r.written[e.Path] = true
+
+	case opRemove:
+		if path.Clean(e.Path) == "/" {
+			return errors.New("cannot remove the root")
+		}
+		delete(r.expect, e.Path)
+		delete(r.versions, e.Path)
+		delete(r.written, e.Path)
+
+		if e.IsDir && e.All {
+			rm := &remover{
+				ctx: r.ctx,
+				sem: make(chan struct{}, maxRemovers),
+			}
+			rm.removeDir(r.dir(e.Path), e.Path)
+			if len(rm.err.Failed) > 0 {
+				return &rm.err
+			}
+			return nil
+		}
+
+		var err error
+		if e.IsDir {
+			_, err = r.dir(e.Path).Delete(r.ctx)
+		} else {
+			url := r.file(e.Path)
+			_, err = r.check(e, url)
+			var conflict *ConflictError
+			if errors.As(err, &conflict) && conflict.Got == azfile.ETagNone {
+				// Already gone, which is all we wanted
+				delete(r.skip, e.Path)
+				return nil
+			}
+			if err == nil {
+				_, err = url.Delete(r.ctx)
+			}
+		}
+		if err != nil && !notFound(err) {
+			return err
+		}
+
+	case opRename:
+		if e.IsDir {
+			return moveDir(r.ctx, r.dir(e.Path), r.dir(e.NewPath))
+		}
+
+		url := r.file(e.Path)
+		_, err := r.check(e, url)
+		if err != nil {
+			return err
+		}
+
+		delete(r.expect, e.Path)
+		delete(r.versions, e.Path)
+		if r.written[e.Path] {
+			delete(r.written, e.Path)
+			r.written[e.NewPath] = true
+		}
+
+		// The copy is a new version we don't learn, later changes to it go unchecked
+		delete(r.expect, e.NewPath)
+		delete(r.versions, e.NewPath)
+		return moveFile(r.ctx, url, r.file(e.NewPath))
+
+	default:
+		return errors.New(`unknown journal op "` + e.Op + `"`)
+	}
+
+	return nil
+}
+
+// Clear the stored MD5 of files replay wrote to, as it is of the old contents
+func (r *replayer) finish() {
+	for full := range r.written {
+		if r.skip[full] {
+			continue
+		}
+
+		url := r.file(full)
+		props, err := url.GetProperties(r.ctx)
+		if err != nil {
+			continue
+		}
+
+		headers := props.NewHTTPHeaders()
+		headers.ContentMD5 = nil
+		set, err := url.SetHTTPHeaders(r.ctx, headers)
+		if err != nil {
+			log.Println("journal could not clear MD5 of", full, "→", err)
+			continue
+		}
+		r.made(full, set.ETag(), set.LastModified())
+	}
+}
+
+// Treat our body as the contents, the journal holds how it got there
+func (b *Blob) Hold() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.hold()
+}
+
+// Treat our body as the contents until replay, the blob lock must be held
+// Azure lacks what the journal holds, so the body is kept and not checked against Azure
+func (b *Blob) hold() {
+	b.loaded = true
+	b.chunks = nil
+	b.pending = true
+}
+
+// Truncate only what we hold, for the journal to replay, returning the version it was made against
+func (b *Blob) truncateHeld(size int64) (azfile.ETag, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.loaded && size > 0 {
+		return azfile.ETagNone, errors.New("contents not held, cannot truncate while Azure is unreachable")
+	}
+
+	resize(b.body, int(size))
+	b.account()
+	b.size = size
+	b.hold()
+
+	return b.base, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A torn last entry is dropped, and cut from the file before anything is appended
+func TestOpenJournalTorn(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "journal")
+	whole := `{"op":"create","path":"/d","dir":true}` + "\n" + `{"op":"write","path":"/d/f","data":"aGk=","base":"\"v1\""}` + "\n"
+	err := ioutil.WriteFile(name, []byte(whole+`{"op":"trunc`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := OpenJournal(name, offlineRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []journalEntry{
+		{Op: opCreate, Path: "/d", IsDir: true},
+		{Op: opWrite, Path: "/d/f", Data: []byte("hi"), Base: `"v1"`},
+	}
+	if !reflect.DeepEqual(j.entries, want) {
+		t.Errorf("read %+v, want %+v", j.entries, want)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte(whole)) {
+		t.Errorf("journal rewritten as %q, want %q", data, whole)
+	}
+}
+
+// Recorded changes hold later ones back, and survive a restart
+func TestJournalRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "journal")
+
+	j, err := OpenJournal(name, offlineRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.holding() {
+		t.Error("empty journal holding changes")
+	}
+
+	recorded := []journalEntry{
+		{Op: opCreate, Path: "/f"},
+		{Op: opTruncate, Path: "/f", Size: 3},
+		{Op: opRemove, Path: "/d", IsDir: true, All: true},
+	}
+	for _, e := range recorded {
+		err := j.record(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !j.holding() {
+		t.Error("journal not holding recorded changes")
+	}
+	j.file.Close()
+
+	j, err = OpenJournal(name, offlineRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.file.Close()
+	if !reflect.DeepEqual(j.entries, recorded) {
+		t.Errorf("reopened with %+v, want %+v", j.entries, recorded)
+	}
+	if waiting, _ := j.Stats(); waiting != len(recorded) {
+		t.Errorf("%d changes waiting, want %d", waiting, len(recorded))
+	}
+
+	// A nil journal never holds
+	var none *Journal
+	if none.holding() {
+		t.Error("nil journal holding changes")
+	}
+}
+
+// Bodies holding journalled changes read without Azure, and are kept until replay
+func TestHeldBody(t *testing.T) {
+	srv := newTestServer()
+	f, err := srv.File.Insert("/f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := f.Blob
+	b.Hold()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setBody([]byte("offline"))
+	defer b.release()
+
+	// The offline share fails any stat
+	err = b.prepare(context.Background())
+	if err != nil {
+		t.Errorf("prepare of a held body failed → %v", err)
+	}
+	if err := b.download(context.Background()); err != nil || string(b.Contents()) != "offline" {
+		t.Errorf("download of a held body gave %q, %v", b.Contents(), err)
+	}
+	if b.idle() {
+		t.Error("held body could be dropped before replay")
+	}
+
+	b.pending = false
+	if !b.idle() {
+		t.Error("replayed body pinned")
+	}
+}
@@ -4,12 +4,18 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"aqwari.net/net/styx"
 	"github.com/Azure/azure-storage-file-go/azfile"
@@ -25,12 +31,45 @@ var (
 	port      = flag.String("p", ":1337", "TCP port to listen for 9p connections")
 	chatty    = flag.Bool("D", false, "Chatty 9p tracing")
 	verbose   = flag.Bool("V", false, "Verbose 9p error output")
+	recursive = flag.Bool("r", false, "Allow removal of non-empty directories")
+	attrTTL   = flag.Duration("attrttl", 5*time.Second, "How long file attributes are cached")
+	dirTTL    = flag.Duration("dirttl", 5*time.Second, "How long directory listings are cached")
+
+	conflictCopy = flag.Bool("conflictcopy", false, "Save writes which conflict with remote changes beside the file")
+
+	cacheDir     = flag.String("cache", "", "Directory to cache file contents in, none if empty")
+	cacheSize    = flag.Int64("cachesize", 1<<30, "Maximum bytes held in the cache directory")
+	memLimit     = flag.Int64("memlimit", 512<<20, "Maximum bytes of file contents held in memory, 0 for no limit")
+	debugAddr    = flag.String("debugaddr", "", "Address to serve usage statistics on at /debug/vars, none if empty")
+	readahead    = flag.Int("readahead", 4, "Chunks to prefetch ahead of sequential reads, 0 to fetch whole files on open")
+	prefetchSize = flag.Int64("prefetch", 0, "Fetch files up to this many bytes once their directory is listed, 0 for none")
+	chunkSize    = flag.Int64("chunksize", maxRange, "Bytes fetched and cached per chunk of a file, at most 4MiB")
+	parallel     = flag.Int("parallel", 4, "Chunks of a file fetched at once")
+	verifyMD5    = flag.Bool("verifymd5", false, "Fail downloads which carry no Content-MD5 to verify")
+	streamSize   = flag.Int64("streamsize", 256<<20, "Read files over this many bytes straight from Azure without holding them, refusing writes, 0 to hold all")
+	defWriteMode = flag.String("writemode", "through", "When writes are uploaded: through on each write, close on clunk, or back after -dirtyage")
+	pathModes    = flag.String("writemodes", "", "Comma separated /prefix=mode overrides of -writemode, such as /logs=back")
+	dirtyAge     = flag.Duration("dirtyage", 30*time.Second, "How long write-back changes, or close-mode ones whose upload failed, may wait before upload")
+	journalPath  = flag.String("journal", "", "File to journal changes in while Azure is unreachable, none if empty")
+	shutdownWait = flag.Duration("shutdown", 30*time.Second, "How long shutdown may take to finish requests and upload changes")
 )
 
 // A 9p file server exposing an azure blob container
 func main() {
 	flag.Parse()
 
+	if *chunkSize < 1 || *chunkSize > maxRange {
+		fatal("err: -chunksize must be between 1 and", maxRange)
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+
+	err := parseWriteModes(*defWriteMode, *pathModes)
+	if err != nil {
+		fatal("err: ", err)
+	}
+
 	var (
 		styxServer styx.Server // 9p file server handle for styx
 		srv        Server      // Our file system server
@@ -38,6 +77,41 @@ func main() {
 
 	srv.Initialize()
 
+	if *cacheDir != "" {
+		var err error
+		diskCache, err = NewDiskCache(*cacheDir, *cacheSize)
+		if err != nil {
+			fatal("err: could not open cache → ", err)
+		}
+	}
+
+	// Usage is published through expvar
+	expvar.Publish("bodybytes", expvar.Func(func() interface{} {
+		return bodies.Used()
+	}))
+	expvar.Publish("cachebytes", expvar.Func(func() interface{} {
+		if diskCache == nil {
+			return int64(0)
+		}
+		return diskCache.Used()
+	}))
+	expvar.Publish("journal", expvar.Func(func() interface{} {
+		if journal == nil {
+			return nil
+		}
+		waiting, conflicts := journal.Stats()
+		return map[string]interface{}{
+			"waiting":   waiting,
+			"conflicts": conflicts,
+		}
+	}))
+
+	if *debugAddr != "" {
+		go func() {
+			log.Println("debug server stopped →", http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
+
 	log.Printf("Using %s as the file share for the fs...\n", *shareName)
 
 	/* Set up Azure */
@@ -97,19 +171,9 @@ func main() {
 
 	/* Populate tree with contents from the share */
 
-	var rootURL azfile.DirectoryURL
-	var files, dirs []string
-	rootStr := "/"
-
-	// Skip population if the container didn't exist, there's nothing contained
-	if !exists {
-		goto Styx
-	}
-
-	log.Println("Reading existing files from share…")
-
 	// Root directory URL for the share
-	rootURL = shareURL.NewRootDirectoryURL()
+	rootURL := shareURL.NewRootDirectoryURL()
+	rootStr := "/"
 	srv.Blob = &Blob{
 		name:   &rootStr,
 		isDir:  true,
@@ -118,43 +182,39 @@ func main() {
 
 	log.Println("¡ ROOTURL = ", rootURL)
 
-	/* List file and directories */
+	// Skip population if the container didn't exist, there's nothing contained
+	if !exists {
+		goto Styx
+	}
 
-	files, dirs = Ls(srv.ctx, rootURL)
-	for _, file := range files {
-		log.Println("Found:", file)
-		log.Println("Before insert:\n", srv)
-		f, err := srv.Insert("/"+file, false)
-		if err != nil {
-			fatal("err: could not insert extant blob file into fs → ", err)
-		}
-		log.Println("After insert:\n", srv)
+	log.Println("Reading existing files from share…")
 
-		err = f.Blob.Download(srv.ctx)
-		if err != nil {
-			fatal("err: could not insert download extant blob file into fs → ", err)
-		}
-	}
-	for _, dir := range dirs {
-		log.Println("Found:", dir+"/")
-		d, err := srv.Insert("/"+dir, true)
-		if err != nil {
-			fatal("err: could not insert extant blob dir into fs → ", err)
-		}
+	/* List file and directories - contents are fetched once opened */
 
-		// Redundant?
-		// TODO - populate children?
-		err = d.Blob.Download(srv.ctx)
-		if err != nil {
-			fatal("err: could not insert download extant blob dir into fs → ", err)
-		}
+	err = srv.File.LoadChildren()
+	if err != nil {
+		fatal("err: could not load extant files into fs → ", err)
 	}
+	log.Println("Found:\n", srv.File)
 
 	log.Println("Finished loading extant files…")
 
 	/* Set up 9p server */
 Styx:
 
+	// Replay searches the tree and root blob, so starts once they are set up
+	if *journalPath != "" {
+		journal, err = OpenJournal(*journalPath, shareURL.NewRootDirectoryURL())
+		if err != nil {
+			fatal("err: could not open journal → ", err)
+		}
+		go journal.run(&srv)
+	}
+
+	// Uploads write-back changes as they come of age
+	// Started after the journal is set, as it checks the journal on every tick
+	go flusher(ctx)
+
 	if *chatty {
 		styxServer.TraceLog = log.New(os.Stderr, "", 0)
 	}
@@ -170,6 +230,30 @@ Styx:
 	// Shim our own logger, in case we need it
 	styxServer.Handler = styx.Stack(logger, &srv)
 
+	l, err := net.Listen("tcp", styxServer.Addr)
+	if err != nil {
+		fatal("err: could not listen → ", err)
+	}
+
+	// Interrupts stop the server, after changes are uploaded
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- styxServer.Serve(l)
+	}()
+
 	log.Println("Listening on tcp!127.0.0.1!" + (*port)[1:] + " …")
-	fatal(styxServer.ListenAndServe())
+
+	select {
+	case err = <-served:
+		fatal(err)
+	case sig := <-sigs:
+		log.Println("Caught", sig, "shutting down…")
+	}
+
+	// Stop accepting connections, those open are refused new requests
+	l.Close()
+	os.Exit(srv.Shutdown(*shutdownWait))
 }
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Accounting of file contents held in memory, dropping idle ones past a limit
+package main
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bytes held in blob bodies across the whole tree
+// Lock order is blob then budget, reclaim takes blob locks with the budget lock released
+type memBudget struct {
+	mu    sync.Mutex
+	used  int64              // Bytes held in bodies
+	blobs map[*Blob]struct{} // Blobs holding any body bytes
+}
+
+// The budget every blob body counts against
+var bodies = &memBudget{blobs: make(map[*Blob]struct{})}
+
+// Bytes currently held in bodies
+func (m *memBudget) Used() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+// Is usage past the limit?
+func (m *memBudget) over() bool {
+	return *memLimit > 0 && m.Used() > *memLimit
+}
+
+// Drop idle bodies, least recently used first, until usage is within the limit
+// No blob lock may be held, each candidate's is taken in turn
+func (m *memBudget) reclaim() {
+	if !m.over() {
+		return
+	}
+
+	m.mu.Lock()
+	blobs := make([]*Blob, 0, len(m.blobs))
+	for b := range m.blobs {
+		blobs = append(blobs, b)
+	}
+	m.mu.Unlock()
+
+	type candidate struct {
+		b    *Blob
+		last time.Time
+	}
+
+	var idle []candidate
+	for _, b := range blobs {
+		b.mu.Lock()
+		if b.idle() {
+			idle = append(idle, candidate{b, b.last})
+		}
+		b.mu.Unlock()
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].last.Before(idle[j].last)
+	})
+
+	for _, c := range idle {
+		if !m.over() {
+			return
+		}
+
+		// May have been opened again since we looked
+		c.b.mu.Lock()
+		if c.b.idle() {
+			log.Println("!!!! EVICTING", *c.b.name)
+			c.b.release()
+		}
+		c.b.mu.Unlock()
+	}
+}
+
+// Bring the budget up to date with the bytes our body holds, the blob lock must be held
+func (b *Blob) account() {
+	held := int64(b.body.Cap())
+	if held == b.held {
+		return
+	}
+
+	bodies.mu.Lock()
+	bodies.used += held - b.held
+	if held > 0 {
+		bodies.blobs[b] = struct{}{}
+	} else {
+		delete(bodies.blobs, b)
+	}
+	bodies.mu.Unlock()
+
+	b.held = held
+}
+
+// Can our body be dropped and fetched again? The blob lock must be held
+// A dirty body holds changes Azure doesn't have yet, so is kept until flushed
+// As is one holding journalled changes, until they are replayed
+func (b *Blob) idle() bool {
+	return b.opens == 0 && b.held > 0 && !b.isDirty() && !b.pending
+}
+
+// Drop our body, it is fetched again on next use, the blob lock must be held
+func (b *Blob) release() {
+	b.body = &bytes.Buffer{}
+	b.loaded = false
+	b.chunks = nil
+	b.account()
+}
+
+// Note a handle was opened, keeping the body until it is closed
+func (b *Blob) opened() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.opens++
+}
+
+// Note a handle was closed
+func (b *Blob) closed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opens > 0 {
+		b.opens--
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Chunked reading of large files, prefetching ahead of sequential readers
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+// A chunk came back from a different version than the rest
+var errChanged = errors.New("file changed remotely while reading")
+
+// Ready a blob for reading
+// Small files are fetched in full, large ones chunk by chunk as they are read, and huge ones not at all
+func (b *Blob) Prepare(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.prepare(ctx)
+}
+
+// Ready a blob for reading
+func (b *Blob) prepare(ctx context.Context) error {
+	if b.isDir || b.pending {
+		// Journalled contents are newer than anything remote, and need no Azure to read
+		return nil
+	}
+
+	// Drops what we hold if it changed remotely
+	err := b.stat(ctx)
+	if err != nil {
+		return err
+	}
+	if b.loaded || b.chunks != nil {
+		return nil
+	}
+
+	if b.streamed() {
+		log.Println("!!!! STREAMING", *b.name)
+		return nil
+	}
+	if *readahead <= 0 || b.size <= *chunkSize {
+		return b.download(ctx)
+	}
+	if diskCache != nil && b.fromCache(b.etag, b.size) {
+		log.Println("!!!! CACHED", *b.name)
+		return nil
+	}
+
+	log.Println("!!!! READING BY CHUNK", *b.name)
+	b.startChunks()
+
+	return nil
+}
+
+// Size the body for the current version and mark every chunk missing, the blob lock must be held
+func (b *Blob) startChunks() {
+	b.last = time.Now()
+	b.body.Reset()
+	resize(b.body, int(b.size))
+	b.account()
+	b.chunks = make([]bool, (b.size+*chunkSize-1) / *chunkSize)
+	b.fetch = make(map[int64]bool)
+	b.next = 0
+	b.base = b.etag
+}
+
+// Bounds of a chunk within the body
+func (b *Blob) chunkRange(index int64) (start, end int64) {
+	start = index * *chunkSize
+	end = start + *chunkSize
+	if end > b.size {
+		end = b.size
+	}
+	return
+}
+
+// Fetch any chunks of [off, off+n) we lack, up to -parallel at once, the blob lock must be held
+// Chunks which arrive are kept when others fail, so a retry resumes where this left off
+func (b *Blob) fill(ctx context.Context, off, n int64) error {
+	b.last = time.Now()
+	b.loadRanges(ctx, b.base)
+
+	var (
+		src   = b.source()
+		wg    sync.WaitGroup
+		mu    sync.Mutex // Guards chunks and first against the fetchers
+		first error      // First fetch to fail
+		sem   = make(chan struct{}, *parallel)
+	)
+
+	for i := off / *chunkSize; i < int64(len(b.chunks)) && i**chunkSize < off+n; i++ {
+		if b.chunks[i] {
+			continue
+		}
+
+		start, end := b.chunkRange(i)
+		p := b.body.Bytes()[start:end]
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := src.fetch(ctx, i, p)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if first == nil {
+					first = err
+				}
+				return
+			}
+			b.chunks[i] = true
+		}(i)
+	}
+	wg.Wait()
+
+	if first != nil {
+		if first == errChanged {
+			// Our chunks are of an older version, start afresh next time
+			b.chunks = nil
+		}
+		return first
+	}
+	b.complete()
+
+	return nil
+}
+
+// Note sequential reads and prefetch ahead of them, the blob lock must be held
+func (b *Blob) readahead(ctx context.Context, off, n int64) {
+	sequential := off == b.next
+	b.next = off + n
+	if !sequential || b.chunks == nil {
+		return
+	}
+
+	src := b.source()
+	first := b.next / *chunkSize
+	for i := first; i < first+int64(*readahead) && i < int64(len(b.chunks)); i++ {
+		if b.chunks[i] || b.fetch[i] {
+			continue
+		}
+
+		b.fetch[i] = true
+		start, end := b.chunkRange(i)
+		go b.prefetch(ctx, src, i, start, end)
+	}
+}
+
+// Fetch a chunk in the background, dropping it if the blob moved on meanwhile
+func (b *Blob) prefetch(ctx context.Context, src chunkSource, index, start, end int64) {
+	p := make([]byte, end-start)
+	err := src.fetch(ctx, index, p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.fetch, index)
+	if err != nil {
+		log.Println("prefetch of", *b.name, "failed →", err)
+		return
+	}
+	if b.chunks == nil || b.base != src.etag || b.chunks[index] {
+		return
+	}
+
+	copy(b.body.Bytes()[start:end], p)
+	b.chunks[index] = true
+	b.complete()
+}
+
+// Once every chunk has arrived the body holds the whole file, the blob lock must be held
+func (b *Blob) complete() {
+	for _, have := range b.chunks {
+		if !have {
+			return
+		}
+	}
+
+	b.chunks = nil
+	b.fetch = nil
+	b.loaded = true
+}
+
+// Where the chunks of one version of a file come from
+// Copied out under the blob lock so chunks can be fetched without it
+type chunkSource struct {
+	url    azfile.FileURL
+	key    string         // Key in the disk cache
+	etag   azfile.ETag    // Version the chunks are of
+	ranges []azfile.Range // Ranges of the version holding data, nil if unknown
+}
+
+// Where our chunks come from, the blob lock must be held
+func (b *Blob) source() chunkSource {
+	src := chunkSource{
+		url:  b.fileURL,
+		key:  b.cacheKey(),
+		etag: b.base,
+	}
+	if b.rangesOf == b.base {
+		src.ranges = b.ranges
+	}
+
+	return src
+}
+
+// Learn which ranges of version etag hold data, the blob lock must be held
+// Asked once per version, without them every byte is fetched
+func (b *Blob) loadRanges(ctx context.Context, etag azfile.ETag) {
+	if b.rangesOf == etag {
+		return
+	}
+	b.rangesOf = etag
+	b.ranges = nil
+
+	list, err := b.fileURL.GetRangeList(ctx, 0, azfile.CountToEnd)
+	if err != nil {
+		log.Println("range list of", *b.name, "failed →", err)
+		return
+	}
+	if list.ETag() != etag {
+		// Changed since we looked, fetching will notice
+		return
+	}
+
+	// No ranges at all is a file of only holes, not an unknown
+	b.ranges = list.Items
+	if b.ranges == nil {
+		b.ranges = []azfile.Range{}
+	}
+}
+
+// Read chunk index into p, from the disk cache if it holds it
+// Holes in the file read as zero without being fetched
+func (s chunkSource) fetch(ctx context.Context, index int64, p []byte) error {
+	if diskCache != nil && diskCache.Get(s.key, s.etag, index, p) {
+		return nil
+	}
+
+	start := index * *chunkSize
+	err := s.read(ctx, start, p)
+	if err != nil {
+		return err
+	}
+
+	if diskCache != nil {
+		diskCache.Put(s.key, s.etag, index, p)
+	}
+
+	return nil
+}
+
+// Read our version at start into p, holes read as zero without being fetched
+func (s chunkSource) read(ctx context.Context, start int64, p []byte) error {
+	if s.ranges == nil {
+		return s.get(ctx, start, p)
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	end := start + int64(len(p))
+	for _, r := range clipRanges(s.ranges, start, end) {
+		err := s.get(ctx, r.Start, p[r.Start-start:r.End+1-start])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The parts of ranges within [start, end), the rest being holes
+// Ranges are sorted and their ends inclusive, as are those returned
+func clipRanges(ranges []azfile.Range, start, end int64) []azfile.Range {
+	first := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].End >= start
+	})
+
+	var clipped []azfile.Range
+	for _, r := range ranges[first:] {
+		if r.Start >= end {
+			break
+		}
+
+		if r.Start < start {
+			r.Start = start
+		}
+		if r.End >= end {
+			r.End = end - 1
+		}
+		clipped = append(clipped, r)
+	}
+
+	return clipped
+}
+
+// Read the range of our version at off into p
+func (s chunkSource) get(ctx context.Context, off int64, p []byte) error {
+	got, err := getRange(ctx, s.url, off, p)
+	if err != nil {
+		return err
+	}
+	if got != s.etag {
+		return errChanged
+	}
+
+	return nil
+}
+
+// Read a range of a file into p, returning the version it came from
+// Ranges are at most a chunk, small enough for Azure to send their MD5 to check against
+func getRange(ctx context.Context, url azfile.FileURL, off int64, p []byte) (azfile.ETag, error) {
+	resp, err := url.Download(ctx, off, int64(len(p)), true)
+	if err != nil {
+		return azfile.ETagNone, errors.New("ranged download failed → " + err.Error())
+	}
+
+	body := resp.Body(azfile.RetryReaderOptions{MaxRetryRequests: maxRetry})
+	defer body.Close()
+
+	_, err = io.ReadFull(body, p)
+	if err != nil {
+		return azfile.ETagNone, errors.New("ranged read failed → " + err.Error())
+	}
+
+	err = checkMD5(resp.ContentMD5(), p)
+	if err != nil {
+		return azfile.ETagNone, err
+	}
+
+	return resp.ETag(), nil
+}
+
+// Fetch small files in the background, such as once their directory is listed
+func prefetchFiles(ctx context.Context, blobs []*Blob) {
+	for _, b := range blobs {
+		b.mu.Lock()
+		if !b.loaded && b.chunks == nil && b.size <= *prefetchSize {
+			err := b.download(ctx)
+			if err != nil {
+				log.Println("prefetch of", *b.name, "failed →", err)
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	bodies.reclaim()
+}
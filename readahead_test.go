@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-storage-file-go/azfile"
+)
+
+// Only the parts of ranges within a chunk are fetched
+func TestClipRanges(t *testing.T) {
+	ranges := []azfile.Range{{Start: 0, End: 9}, {Start: 20, End: 39}, {Start: 50, End: 50}, {Start: 64, End: 99}}
+
+	tests := []struct {
+		start, end int64
+		want       []azfile.Range
+	}{
+		{0, 10, []azfile.Range{{Start: 0, End: 9}}},
+		{0, 5, []azfile.Range{{Start: 0, End: 4}}},
+		{5, 25, []azfile.Range{{Start: 5, End: 9}, {Start: 20, End: 24}}},
+		{10, 20, nil},
+		{25, 64, []azfile.Range{{Start: 25, End: 39}, {Start: 50, End: 50}}},
+		{50, 51, []azfile.Range{{Start: 50, End: 50}}},
+		{51, 64, nil},
+		{63, 65, []azfile.Range{{Start: 64, End: 64}}},
+		{100, 200, nil},
+	}
+
+	for _, test := range tests {
+		got := clipRanges(ranges, test.start, test.end)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("clip to [%d, %d) gave %v, want %v", test.start, test.end, got, test.want)
+		}
+	}
+
+	if got := clipRanges(nil, 0, 10); got != nil {
+		t.Errorf("clip of no ranges gave %v", got)
+	}
+}
+
+// A chunk lying wholly in a hole reads as zero without a request
+func TestFetchHole(t *testing.T) {
+	smallChunks(t)
+	old := diskCache
+	diskCache = nil
+	defer func() { diskCache = old }()
+
+	src := chunkSource{
+		url:    offlineRoot().NewFileURL("f"),
+		etag:   "v1",
+		ranges: []azfile.Range{{Start: 0, End: 15}},
+	}
+
+	p := []byte("stale stale stal")
+	err := src.fetch(context.Background(), 1, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range p {
+		if c != 0 {
+			t.Fatalf("byte %d of a hole is %d", i, c)
+		}
+	}
+}
+
+// Holes in a streamed file read as zero without a request
+func TestStreamHole(t *testing.T) {
+	old := *streamSize
+	*streamSize = 16
+	defer func() { *streamSize = old }()
+
+	srv := newTestServer()
+	f, err := srv.File.Insert("/image", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := f.Blob
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = 64
+	b.setVersion("v1", b.lastMod)
+	b.rangesOf = "v1"
+	b.ranges = []azfile.Range{{Start: 0, End: 7}}
+	if !b.streamed() {
+		t.Fatal("file over -streamsize not streamed")
+	}
+
+	p := []byte("stale stale stale stale")
+	n, err := b.readStream(context.Background(), p, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(p) {
+		t.Errorf("read %d bytes, want %d", n, len(p))
+	}
+	for i, c := range p {
+		if c != 0 {
+			t.Fatalf("byte %d of a hole is %d", i, c)
+		}
+	}
+}
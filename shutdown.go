@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Stopping the server without losing changes Azure lacks
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// A request arrived after shutdown began
+var errShutdown = errors.New("server shutting down")
+
+// Start serving a request, false once shutdown has begun
+func (s *Server) enter() bool {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+
+	return true
+}
+
+// Finish serving a request
+func (s *Server) leave() {
+	s.inflight.Done()
+}
+
+// Refuse new requests and wait up to timeout for those being served, false if some remain
+func (s *Server) drain(timeout time.Duration) bool {
+	s.state.Lock()
+	s.closing = true
+	s.state.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop serving and upload every change Azure lacks, all within timeout
+// Changes which cannot be uploaded are journalled if there is a journal
+// Returns the status to exit with, non-zero if any change was lost
+func (s *Server) Shutdown(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+
+	// What the requests cut off were changing can't be known, so assume the worst
+	drained := s.drain(timeout)
+	if !drained {
+		log.Println("requests still in flight at shutdown, their changes may be lost")
+	}
+
+	ctx, cancel := context.WithDeadline(s.ctx, deadline)
+	defer cancel()
+
+	done := make(chan []string, 1)
+	go func() {
+		done <- s.flushAll(ctx)
+	}()
+
+	var lost []string
+	select {
+	case lost = <-done:
+	case <-ctx.Done():
+		// Stuck behind a transfer holding a blob, whatever is still dirty is lost
+		for _, b := range dirtyBlobs() {
+			lost = append(lost, *b.name)
+		}
+	}
+
+	if len(lost) > 0 || !drained {
+		for _, name := range lost {
+			log.Println("changes to", name, "were lost")
+		}
+		return 1
+	}
+
+	log.Println("All changes saved, exiting…")
+	return 0
+}
+
+// Upload every dirty body, journalling those which fail, returning the names of those lost
+func (s *Server) flushAll(ctx context.Context) []string {
+	// Paths first, the tree lock is taken before blob locks
+	paths := make(map[*Blob]string)
+	s.tree.RLock()
+	s.File.dirtyPaths(paths)
+	s.tree.RUnlock()
+
+	var lost []string
+	for _, b := range dirtyBlobs() {
+		b.mu.Lock()
+		err := b.flush(ctx)
+		if err != nil && b.isDirty() && journal != nil {
+			full, ok := paths[b]
+			if ok {
+				err = b.journalBody(full)
+			}
+		}
+		if err != nil && b.isDirty() {
+			log.Println("flush of", *b.name, "at shutdown failed →", err)
+			lost = append(lost, *b.name)
+		}
+
+		// A conflict gives up on our changes, which survive only in a copy
+		var conflict *ConflictError
+		if errors.As(err, &conflict) && conflict.Copy == "" {
+			log.Println("flush of", *b.name, "at shutdown conflicted →", err)
+			lost = append(lost, *b.name)
+		}
+		b.mu.Unlock()
+	}
+
+	return lost
+}
+
+// Collect the paths of files holding changes not yet uploaded, the tree lock must be held
+func (t *File) dirtyPaths(paths map[*Blob]string) {
+	t.children.each(func(child *File) {
+		if child.isDir {
+			child.dirtyPaths(paths)
+		} else if child.Blob.isDirty() {
+			paths[child.Blob] = child.path()
+		}
+	})
+}
+
+// Keep our whole body in the journal, to be replayed over the version it was made against
+// Written in parts so no entry outgrows what the journal reads back, the blob lock must be held
+func (b *Blob) journalBody(full string) error {
+	data := b.Contents()
+	base := b.base
+
+	for off := int64(0); off < int64(len(data)); off += maxRange {
+		stop := off + maxRange
+		if stop > int64(len(data)) {
+			stop = int64(len(data))
+		}
+
+		err := journal.record(journalEntry{Op: opWrite, Path: full, Off: off, Data: append([]byte(nil), data[off:stop]...), Base: base})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The body may have shrunk below what Azure holds
+	err := journal.record(journalEntry{Op: opTruncate, Path: full, Size: int64(len(data)), Base: base})
+	if err != nil {
+		return err
+	}
+
+	b.setClean()
+	b.hold()
+	return nil
+}
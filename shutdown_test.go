@@ -0,0 +1,29 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Shutdown exits non-zero when requests it waited on never finished
+func TestShutdownStatus(t *testing.T) {
+	srv := newTestServer()
+	if status := srv.Shutdown(time.Second); status != 0 {
+		t.Errorf("idle shutdown exited %d", status)
+	}
+	if srv.enter() {
+		t.Error("request served after shutdown")
+	}
+
+	srv = newTestServer()
+	if !srv.enter() {
+		t.Fatal("request refused before shutdown")
+	}
+	defer srv.leave()
+	if status := srv.Shutdown(10 * time.Millisecond); status != 1 {
+		t.Errorf("shutdown cutting off a request exited %d", status)
+	}
+}
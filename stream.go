@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// Reading of huge files straight from Azure, without holding their contents
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Holding the contents would take more memory than -streamsize allows
+var errTooBig = errors.New("file is over -streamsize, it can only be read")
+
+// Are reads served straight from Azure? The blob lock must be held
+// Only files over -streamsize, which are never held in full
+func (b *Blob) streamed() bool {
+	return !b.isDir && !b.loaded && b.chunks == nil && tooBig(b.size)
+}
+
+// Is size too large to hold?
+func tooBig(size int64) bool {
+	return *streamSize > 0 && size > *streamSize
+}
+
+// Read from Azure at off into p, keeping nothing, the blob lock must be held
+func (b *Blob) readStream(ctx context.Context, p []byte, off int64) (int, error) {
+	b.last = time.Now()
+
+	for retried := false; ; retried = true {
+		if off >= b.size {
+			return 0, io.EOF
+		}
+
+		n := int64(len(p))
+		if n > b.size-off {
+			n = b.size - off
+		}
+		if n > maxRange {
+			n = maxRange
+		}
+
+		// Huge files are often preallocated images, mostly holes which need no fetching
+		b.loadRanges(ctx, b.etag)
+		src := chunkSource{url: b.fileURL, etag: b.etag}
+		if b.rangesOf == b.etag {
+			src.ranges = b.ranges
+		}
+
+		err := src.read(ctx, off, p[:n])
+		if err == nil {
+			return int(n), nil
+		}
+		if err != errChanged || retried {
+			return 0, err
+		}
+
+		// Changed since we looked, such as a log being appended to, so pick up the new size
+		err = b.stat(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -89,6 +89,9 @@ func intersect(a, b []string) []string {
 
 // Print a tree, nicely
 func (t *File) String() string {
+	t.srv.tree.RLock()
+	defer t.srv.tree.RUnlock()
+
 	var descend func(depth uint64, t *File) string
 
 	descend = func(depth uint64, t *File) string {
@@ -108,9 +111,9 @@ func (t *File) String() string {
 
 		depth++
 
-		for _, child := range t.Children {
+		t.children.each(func(child *File) {
 			s += descend(depth, child)
-		}
+		})
 
 		return s
 	}
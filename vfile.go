@@ -14,8 +14,10 @@ import (
 )
 
 // Virtual file wrapper for 9p operations on a File
+// Each open handle gets its own VFile, so per-handle state lives here
 type VFile struct {
 	*File
+	dir *dirCursor // Our position in a directory listing
 }
 
 // Uid
@@ -35,6 +37,7 @@ func (vf VFile) Muid() string {
 
 // Close file
 func (vf VFile) Close() error {
+	vf.dir.rewind()
 	return vf.File.Close()
 }
 
@@ -73,6 +76,11 @@ func (vf VFile) Sys() interface{} {
 	return vf.File.Sys()
 }
 
+// Qid version, for servers able to take one from the file
+func (vf VFile) Version() uint32 {
+	return vf.File.Version()
+}
+
 // Returns the info that styx wants
 func (vf VFile) Stat() os.FileInfo {
 	return vf.File.Stat()
@@ -80,5 +88,5 @@ func (vf VFile) Stat() os.FileInfo {
 
 // If we are a directory, avoid calling ReadAt()?
 func (vf VFile) Readdir(n int) ([]os.FileInfo, error) {
-	return vf.File.Readdir(n)
+	return vf.File.readdir(vf.dir, n)
 }
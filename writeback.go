@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+// When writes are uploaded to Azure, chosen by path
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When the writes to a file are uploaded
+type writeMode int
+
+const (
+	writeThrough writeMode = iota // On every write
+	writeOnClose                  // When a handle which wrote is closed
+	writeBack                     // In the background, once dirty for -dirtyage
+)
+
+// Names of write modes as given to flags
+var writeModeNames = map[string]writeMode{
+	"through": writeThrough,
+	"close":   writeOnClose,
+	"back":    writeBack,
+}
+
+// A write mode for the paths beneath a prefix
+type modeRule struct {
+	prefix string
+	mode   writeMode
+}
+
+var (
+	defaultMode writeMode  // Mode for paths no rule matches
+	modeRules   []modeRule // Longest prefix first
+)
+
+// Set up write modes from a mode name and a list of prefix=mode overrides
+// Overrides are comma separated, such as "/logs=back,/db=through"
+func parseWriteModes(def, overrides string) error {
+	mode, ok := writeModeNames[def]
+	if !ok {
+		return errors.New(`unknown write mode "` + def + `"`)
+	}
+	defaultMode = mode
+
+	modeRules = nil
+	for _, rule := range strings.Split(overrides, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return errors.New(`write mode override "` + rule + `" is not /prefix=mode`)
+		}
+		mode, ok := writeModeNames[parts[1]]
+		if !ok {
+			return errors.New(`unknown write mode "` + parts[1] + `"`)
+		}
+
+		modeRules = append(modeRules, modeRule{strings.TrimSuffix(parts[0], "/"), mode})
+	}
+
+	sort.Slice(modeRules, func(i, j int) bool {
+		return len(modeRules[i].prefix) > len(modeRules[j].prefix)
+	})
+
+	return nil
+}
+
+// The write mode for the file at full
+func modeFor(full string) writeMode {
+	for _, rule := range modeRules {
+		if full == rule.prefix || strings.HasPrefix(full, rule.prefix+"/") {
+			return rule.mode
+		}
+	}
+
+	return defaultMode
+}
+
+// Blobs holding changes not yet uploaded
+// Lock order is blob then dirty set, flushers take blob locks with the set lock released
+var dirtied = struct {
+	sync.Mutex
+	blobs map[*Blob]struct{}
+}{blobs: make(map[*Blob]struct{})}
+
+// Note our body holds changes to upload by mode, the blob lock must be held
+func (b *Blob) setDirty(mode writeMode) {
+	if !b.isDirty() {
+		b.dirtySince = time.Now()
+	}
+	b.wmode = mode
+	atomic.StoreUint32(&b.dirty, 1)
+
+	dirtied.Lock()
+	dirtied.blobs[b] = struct{}{}
+	dirtied.Unlock()
+}
+
+// Note Azure has all our changes, or they were given up on, the blob lock must be held
+func (b *Blob) setClean() {
+	atomic.StoreUint32(&b.dirty, 0)
+	b.dirtySince = time.Time{}
+
+	dirtied.Lock()
+	delete(dirtied.blobs, b)
+	dirtied.Unlock()
+}
+
+// Does our body hold changes not yet uploaded?
+// The flag is atomic so the tree lock can read it without waiting on transfers
+func (b *Blob) isDirty() bool {
+	return atomic.LoadUint32(&b.dirty) == 1
+}
+
+// Upload our changes if they were written in mode
+func (b *Blob) FlushMode(ctx context.Context, mode writeMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.wmode != mode {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// Are our changes due for the flusher to upload? The blob lock must be held
+// Changes written on close are too once every handle closed, as the upload on close failed
+func (b *Blob) due() bool {
+	if !b.isDirty() || time.Since(b.dirtySince) < *dirtyAge {
+		return false
+	}
+
+	return b.wmode == writeBack || (b.wmode == writeOnClose && b.opens == 0)
+}
+
+// Blobs with changes not yet uploaded
+func dirtyBlobs() []*Blob {
+	dirtied.Lock()
+	defer dirtied.Unlock()
+
+	blobs := make([]*Blob, 0, len(dirtied.blobs))
+	for b := range dirtied.blobs {
+		blobs = append(blobs, b)
+	}
+
+	return blobs
+}
+
+// Upload write-back changes once they are -dirtyage old, forever
+// Failed uploads stay dirty and are tried again on a later pass, as are failed uploads on close
+func flusher(ctx context.Context) {
+	tick := *dirtyAge / 4
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+
+	for range time.Tick(tick) {
+		if journal.holding() {
+			// Uploads wait for the journal to be replayed first
+			continue
+		}
+
+		for _, b := range dirtyBlobs() {
+			b.mu.Lock()
+			if b.due() {
+				err := b.flush(ctx)
+				if err != nil {
+					log.Println("write-back of", *b.name, "failed →", err)
+				}
+			}
+			b.mu.Unlock()
+		}
+
+		bodies.reclaim()
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Microsoft Corporation, Sean Hinchee.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Overrides must name a prefix and a known mode
+func TestParseWriteModes(t *testing.T) {
+	defer parseWriteModes("through", "")
+
+	good := []struct{ def, overrides string }{
+		{"through", ""},
+		{"back", " /logs=close , /db=through,"},
+		{"close", "/a/=back"},
+	}
+	for _, test := range good {
+		err := parseWriteModes(test.def, test.overrides)
+		if err != nil {
+			t.Errorf("parse of %q, %q failed → %v", test.def, test.overrides, err)
+		}
+	}
+
+	bad := []struct{ def, overrides string }{
+		{"sometimes", ""},
+		{"through", "/logs=sometimes"},
+		{"through", "logs=back"},
+		{"through", "/logs"},
+	}
+	for _, test := range bad {
+		err := parseWriteModes(test.def, test.overrides)
+		if err == nil {
+			t.Errorf("parse of %q, %q succeeded", test.def, test.overrides)
+		}
+	}
+}
+
+// The longest prefix wins, matching whole path elements only
+func TestModeFor(t *testing.T) {
+	defer parseWriteModes("through", "")
+
+	err := parseWriteModes("close", "/logs=back,/logs/audit/=through,/db=through")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		full string
+		want writeMode
+	}{
+		{"/notes", writeOnClose},
+		{"/logs", writeBack},
+		{"/logs/today", writeBack},
+		{"/logs/audit", writeThrough},
+		{"/logs/audit/today", writeThrough},
+		{"/logs/auditor", writeBack},
+		{"/logsheet", writeOnClose},
+		{"/db/table", writeThrough},
+	}
+	for _, test := range tests {
+		if got := modeFor(test.full); got != test.want {
+			t.Errorf("mode for %q is %d, want %d", test.full, got, test.want)
+		}
+	}
+}
+
+// Removing a directory gives up on the changes of everything beneath it
+func TestDiscard(t *testing.T) {
+	srv := newTestServer()
+
+	var files []*File
+	for _, p := range []string{"/d", "/d/e"} {
+		_, err := srv.File.Insert(p, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"/d/f", "/d/e/g", "/h"} {
+		f, err := srv.File.Insert(p, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Blob.mu.Lock()
+		f.Blob.setDirty(writeBack)
+		f.Blob.mu.Unlock()
+		files = append(files, f)
+	}
+	defer files[2].Blob.setClean()
+
+	d, err := srv.File.Search("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.discard()
+
+	for _, f := range files[:2] {
+		if f.Blob.isDirty() {
+			t.Errorf("%q still dirty", f.name)
+		}
+	}
+	if !files[2].Blob.isDirty() {
+		t.Error("file outside the directory cleaned")
+	}
+	for _, b := range dirtyBlobs() {
+		if b == files[0].Blob || b == files[1].Blob {
+			t.Errorf("%q still in the dirty set", *b.name)
+		}
+	}
+}
+
+// The flusher takes write-back changes once old enough, and close-mode ones once closed
+func TestDue(t *testing.T) {
+	old := *dirtyAge
+	*dirtyAge = time.Minute
+	defer func() { *dirtyAge = old }()
+
+	name := "f"
+	b := NewBlob(&name, offlineRoot(), false)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.setClean()
+
+	tests := []struct {
+		mode  writeMode
+		age   time.Duration
+		opens int
+		want  bool
+	}{
+		{writeBack, 0, 0, false},
+		{writeBack, time.Hour, 1, true},
+		{writeOnClose, time.Hour, 1, false},
+		{writeOnClose, time.Hour, 0, true},
+		{writeOnClose, 0, 0, false},
+		{writeThrough, time.Hour, 0, false},
+	}
+	for _, test := range tests {
+		b.setDirty(test.mode)
+		b.dirtySince = time.Now().Add(-test.age)
+		b.opens = test.opens
+		if got := b.due(); got != test.want {
+			t.Errorf("mode %d, dirty %v, %d open: due %v, want %v", test.mode, test.age, test.opens, got, test.want)
+		}
+	}
+
+	b.setClean()
+	if b.due() {
+		t.Error("clean blob due")
+	}
+}